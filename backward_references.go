@@ -48,7 +48,7 @@ func createBackwardReferences(num_bytes uint, position uint, ringbuffer []byte,
 	}
 	var random_heuristics_window_size uint = literalSpreeLengthForSparseSearch(params)
 	var apply_random_heuristics uint = position + random_heuristics_window_size
-	var gap uint = 0
+	var gap uint = uint(len(params.dictionary.compound.source))
 	/* Set maximum distance, see section 9.1. of the spec. */
 
 	const kMinScore uint = scoreBase + 100
@@ -63,11 +63,15 @@ func createBackwardReferences(num_bytes uint, position uint, ringbuffer []byte,
 	for position+hasher.HashTypeLength() < pos_end {
 		var max_length uint = pos_end - position
 		var max_distance uint = brotli_min_size_t(position, max_backward_limit)
+		var dictionary_start uint = brotli_min_size_t(position+params.stream_offset, max_backward_limit)
 		sr.len = 0
 		sr.len_code_delta = 0
 		sr.distance = 0
 		sr.score = kMinScore
-		hasher.FindLongestMatch(&params.dictionary, ringbuffer, ringbuffer_mask, dist_cache, position, max_length, max_distance, gap, params.dist.max_distance, &sr)
+		hasher.FindLongestMatch(&params.dictionary, ringbuffer, ringbuffer_mask, dist_cache, position, max_length, max_distance, dictionary_start+gap, params.dist.max_distance, &sr)
+		if gap != 0 {
+			findCompoundDictionaryMatch(&params.dictionary.compound, ringbuffer, ringbuffer_mask, dist_cache, position, max_length, dictionary_start, params.dist.max_distance, &sr)
+		}
 		if sr.score > kMinScore {
 			/* Found a match. Let's look for something even better ahead. */
 			var delayed_backward_references_in_row int = 0
@@ -83,7 +87,11 @@ func createBackwardReferences(num_bytes uint, position uint, ringbuffer []byte,
 				sr2.distance = 0
 				sr2.score = kMinScore
 				max_distance = brotli_min_size_t(position+1, max_backward_limit)
-				hasher.FindLongestMatch(&params.dictionary, ringbuffer, ringbuffer_mask, dist_cache, position+1, max_length, max_distance, gap, params.dist.max_distance, &sr2)
+				dictionary_start = brotli_min_size_t(position+1+params.stream_offset, max_backward_limit)
+				hasher.FindLongestMatch(&params.dictionary, ringbuffer, ringbuffer_mask, dist_cache, position+1, max_length, max_distance, dictionary_start+gap, params.dist.max_distance, &sr2)
+				if gap != 0 {
+					findCompoundDictionaryMatch(&params.dictionary.compound, ringbuffer, ringbuffer_mask, dist_cache, position+1, max_length, dictionary_start, params.dist.max_distance, &sr2)
+				}
 				if sr2.score >= sr.score+cost_diff_lazy {
 					/* Ok, let's just write one byte for now and start a match from the
 					   next byte. */
@@ -101,12 +109,12 @@ func createBackwardReferences(num_bytes uint, position uint, ringbuffer []byte,
 			}
 
 			apply_random_heuristics = position + 2*sr.len + random_heuristics_window_size
-			max_distance = brotli_min_size_t(position, max_backward_limit)
+			dictionary_start = brotli_min_size_t(position+params.stream_offset, max_backward_limit)
 			{
 				/* The first 16 codes are special short-codes,
 				   and the minimum offset is 1. */
-				var distance_code uint = computeDistanceCode(sr.distance, max_distance+gap, dist_cache)
-				if (sr.distance <= (max_distance + gap)) && distance_code > 0 {
+				var distance_code uint = computeDistanceCode(sr.distance, dictionary_start+gap, dist_cache)
+				if (sr.distance <= (dictionary_start + gap)) && distance_code > 0 {
 					dist_cache[3] = dist_cache[2]
 					dist_cache[2] = dist_cache[1]
 					dist_cache[1] = dist_cache[0]
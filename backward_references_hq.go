@@ -307,7 +307,8 @@ func computeMinimumCopyLength(start_cost float32, nodes []zopfliNode, num_bytes
 }
 
 /* REQUIRES: nodes[pos].cost < kInfinity
-   REQUIRES: nodes[0..pos] satisfies that "ZopfliNode array invariant". */
+   REQUIRES: nodes[0..pos] satisfies that "ZopfliNode array invariant".
+   |block_start| includes the stream offset of the encoder parameters. */
 func computeDistanceShortcut(block_start uint, pos uint, max_backward_limit uint, gap uint, nodes []zopfliNode) uint32 {
 	var clen uint = uint(zopfliNodeCopyLength(&nodes[pos]))
 	var ilen uint = uint(nodes[pos].dcode_insert_length & 0x7FFFFFF)
@@ -375,15 +376,16 @@ func updateNodes(num_bytes uint, block_start uint, pos uint, ringbuffer []byte,
 	var cur_ix uint = block_start + pos
 	var cur_ix_masked uint = cur_ix & ringbuffer_mask
 	var max_distance uint = brotli_min_size_t(cur_ix, max_backward_limit)
+	var dictionary_start uint = brotli_min_size_t(cur_ix+params.stream_offset, max_backward_limit)
 	var max_len uint = num_bytes - pos
 	var max_zopfli_len uint = maxZopfliLen(params)
 	var max_iters uint = maxZopfliCandidates(params)
 	var min_len uint
 	var result uint = 0
 	var k uint
-	var gap uint = 0
+	var gap uint = uint(len(params.dictionary.compound.source))
 
-	evaluateNode(block_start, pos, max_backward_limit, gap, starting_dist_cache, model, queue, nodes)
+	evaluateNode(block_start+params.stream_offset, pos, max_backward_limit, gap, starting_dist_cache, model, queue, nodes)
 	{
 		var posdata *posData = startPosQueueAt(queue, 0)
 		var min_cost float32 = (posdata.cost + zopfliCostModelGetMinCostCmd(model) + zopfliCostModelGetLiteralCosts(model, posdata.pos, pos))
@@ -412,7 +414,7 @@ func updateNodes(num_bytes uint, block_start uint, pos uint, ringbuffer []byte,
 				break
 			}
 
-			if backward > max_distance+gap {
+			if backward > dictionary_start+gap {
 				/* Word dictionary -> ignore. */
 				continue
 			}
@@ -467,7 +469,7 @@ func updateNodes(num_bytes uint, block_start uint, pos uint, ringbuffer []byte,
 			for j = 0; j < num_matches; j++ {
 				var match backwardMatch = matches[j]
 				var dist uint = uint(match.distance)
-				var is_dictionary_match bool = (dist > max_distance+gap)
+				var is_dictionary_match bool = (dist > dictionary_start+gap)
 				var dist_code uint = dist + numDistanceShortCodes - 1
 				var dist_symbol uint16
 				var distextra uint32
@@ -535,7 +537,7 @@ func zopfliCreateCommands(num_bytes uint, block_start uint, nodes []zopfliNode,
 	var pos uint = 0
 	var offset uint32 = nodes[0].u.next
 	var i uint
-	var gap uint = 0
+	var gap uint = uint(len(params.dictionary.compound.source))
 	for i = 0; offset != math.MaxUint32; i++ {
 		var next *zopfliNode = &nodes[uint32(pos)+offset]
 		var copy_length uint = uint(zopfliNodeCopyLength(next))
@@ -549,8 +551,8 @@ func zopfliCreateCommands(num_bytes uint, block_start uint, nodes []zopfliNode,
 		{
 			var distance uint = uint(zopfliNodeCopyDistance(next))
 			var len_code uint = uint(zopfliNodeLengthCode(next))
-			var max_distance uint = brotli_min_size_t(block_start+pos, max_backward_limit)
-			var is_dictionary bool = (distance > max_distance+gap)
+			var dictionary_start uint = brotli_min_size_t(block_start+pos+params.stream_offset, max_backward_limit)
+			var is_dictionary bool = (distance > dictionary_start+gap)
 			var dist_code uint = uint(zopfliNodeDistanceCode(next))
 			initCommand(&commands[i], &params.dist, insert_length, copy_length, int(len_code)-int(copy_length), dist_code)
 
@@ -595,7 +597,7 @@ func zopfliIterate(num_bytes uint, position uint, ringbuffer []byte, ringbuffer_
 				if i+3 >= num_bytes {
 					break
 				}
-				evaluateNode(position, i, max_backward_limit, gap, dist_cache, model, &queue, nodes)
+				evaluateNode(position+params.stream_offset, i, max_backward_limit, gap, dist_cache, model, &queue, nodes)
 				cur_match_pos += uint(num_matches[i])
 				skip--
 			}
@@ -633,7 +635,7 @@ func zopfliComputeShortestPath(num_bytes uint, position uint, ringbuffer []byte,
 		store_end = position
 	}
 	var i uint
-	var gap uint = 0
+	var gap uint = uint(len(params.dictionary.compound.source))
 	var lz_matches_offset uint = 0
 	nodes[0].length = 0
 	nodes[0].u.cost = 0
@@ -643,9 +645,10 @@ func zopfliComputeShortestPath(num_bytes uint, position uint, ringbuffer []byte,
 	for i = 0; i+hasher.HashTypeLength()-1 < num_bytes; i++ {
 		var pos uint = position + i
 		var max_distance uint = brotli_min_size_t(pos, max_backward_limit)
+		var dictionary_start uint = brotli_min_size_t(pos+params.stream_offset, max_backward_limit)
 		var skip uint
 		var num_matches uint
-		num_matches = findAllMatchesH10(hasher, &params.dictionary, ringbuffer, ringbuffer_mask, pos, num_bytes-i, max_distance, gap, params, matches[lz_matches_offset:])
+		num_matches = findAllMatchesH10(hasher, &params.dictionary, ringbuffer, ringbuffer_mask, pos, num_bytes-i, max_distance, dictionary_start, gap, params, matches[lz_matches_offset:])
 		if num_matches > 0 && backwardMatchLength(&matches[num_matches-1]) > max_zopfli_len {
 			matches[0] = matches[num_matches-1]
 			num_matches = 1
@@ -669,7 +672,7 @@ func zopfliComputeShortestPath(num_bytes uint, position uint, ringbuffer []byte,
 				if i+hasher.HashTypeLength()-1 >= num_bytes {
 					break
 				}
-				evaluateNode(position, i, max_backward_limit, gap, dist_cache, &model, &queue, nodes)
+				evaluateNode(position+params.stream_offset, i, max_backward_limit, gap, dist_cache, &model, &queue, nodes)
 				skip--
 			}
 		}
@@ -707,12 +710,13 @@ func createHqZopfliBackwardReferences(num_bytes uint, position uint, ringbuffer
 	var model zopfliCostModel
 	var nodes []zopfliNode
 	var matches []backwardMatch = make([]backwardMatch, matches_size)
-	var gap uint = 0
+	var gap uint = uint(len(params.dictionary.compound.source))
 	var shadow_matches uint = 0
 	var new_array []backwardMatch
 	for i = 0; i+hasher.HashTypeLength()-1 < num_bytes; i++ {
 		var pos uint = position + i
 		var max_distance uint = brotli_min_size_t(pos, max_backward_limit)
+		var dictionary_start uint = brotli_min_size_t(pos+params.stream_offset, max_backward_limit)
 		var max_length uint = num_bytes - i
 		var num_found_matches uint
 		var cur_match_end uint
@@ -738,7 +742,7 @@ func createHqZopfliBackwardReferences(num_bytes uint, position uint, ringbuffer
 			matches_size = new_size
 		}
 
-		num_found_matches = findAllMatchesH10(hasher.(*h10), &params.dictionary, ringbuffer, ringbuffer_mask, pos, max_length, max_distance, gap, params, matches[cur_match_pos+shadow_matches:])
+		num_found_matches = findAllMatchesH10(hasher.(*h10), &params.dictionary, ringbuffer, ringbuffer_mask, pos, max_length, max_distance, dictionary_start, gap, params, matches[cur_match_pos+shadow_matches:])
 		cur_match_end = cur_match_pos + num_found_matches
 		for j = cur_match_pos; j+1 < cur_match_end; j++ {
 			assert(backwardMatchLength(&matches[j]) <= backwardMatchLength(&matches[j+1]))
@@ -6,18 +6,29 @@
 package brotli
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"testing/iotest"
 	"time"
 )
 
 func checkCompressedData(compressedData, wantOriginalData []byte) error {
-	uncompressed, err := Decode(compressedData)
+	uncompressed, err := decodeStream(compressedData)
 	if err != nil {
 		return fmt.Errorf("brotli decompress failed: %v", err)
 	}
@@ -174,6 +185,835 @@ func TestEncoderFlush(t *testing.T) {
 	}
 }
 
+func TestWriterReset(t *testing.T) {
+	inputs := [][]byte{
+		bytes.Repeat([]byte("<html><body><H1>Hello world</H1></body></html>"), 1000),
+		[]byte("A"),
+		nil,
+		make([]byte, 100000),
+		bytes.Repeat([]byte("hello world!"), 10000),
+	}
+	rand.New(rand.NewSource(0)).Read(inputs[3][:50000])
+	for _, q := range []int{0, 1, 2, 4, 5, 9, 10, 11} {
+		options := WriterOptions{Quality: q}
+		var out bytes.Buffer
+		w := NewWriter(&out, options)
+		for i, input := range inputs {
+			want, err := encodeStream(input, options)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			out.Reset()
+			w.Reset(&out)
+			if _, err := w.Write(input); err != nil {
+				t.Fatalf("q=%d input %d: Write: %v", q, i, err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("q=%d input %d: Close: %v", q, i, err)
+			}
+			if !bytes.Equal(out.Bytes(), want) {
+				t.Errorf("q=%d input %d: reused Writer produced %d bytes, new Writer %d bytes", q, i, out.Len(), len(want))
+			}
+		}
+	}
+}
+
+func TestReaderReset(t *testing.T) {
+	inputs := [][]byte{
+		bytes.Repeat([]byte("hello world!"), 10000),
+		[]byte("A"),
+		nil,
+		make([]byte, 1<<20),
+		bytes.Repeat([]byte("<html><body><H1>Hello world</H1></body></html>"), 10),
+	}
+	rand.New(rand.NewSource(0)).Read(inputs[3][:1<<19])
+	r := NewReader(nil)
+	for i, input := range inputs {
+		encoded, err := encodeStream(input, WriterOptions{Quality: 5, LGWin: 20})
+		if err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+		if err := r.Reset(bytes.NewReader(encoded)); err != nil {
+			t.Fatalf("Reset: %v", err)
+		}
+		decoded, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("input %d: ReadAll: %v", i, err)
+		}
+		if !bytes.Equal(decoded, input) {
+			t.Errorf("input %d: reused Reader decoded %d bytes, want %d", i, len(decoded), len(input))
+		}
+	}
+
+	// A Reset after an error must clear it.
+	r.Reset(bytes.NewReader([]byte{0xff, 0xff, 0xff}))
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Fatalf("ReadAll of corrupt input: got nil error")
+	}
+	encoded, _ := encodeStream(inputs[0], WriterOptions{Quality: 5})
+	r.Reset(bytes.NewReader(encoded))
+	if decoded, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(decoded, inputs[0]) {
+		t.Errorf("ReadAll after Reset = <%d bytes>, %v; want <%d bytes>, nil", len(decoded), err, len(inputs[0]))
+	}
+}
+
+// utf8Text returns about n bytes of pseudo-random multilingual UTF-8 text.
+func utf8Text(n int) []byte {
+	words := strings.Fields("съешь же ещё этих мягких французских булок да выпей чаю " +
+		"the quick brown fox jumps over the lazy dog café naïve façade " +
+		"日本語 テキスト 東京 漢字 γειά σου κόσμε")
+	rnd := rand.New(rand.NewSource(1))
+	var b bytes.Buffer
+	for b.Len() < n {
+		b.WriteString(words[rnd.Intn(len(words))])
+		if rnd.Intn(12) == 0 {
+			b.WriteString(".\n")
+		} else {
+			b.WriteByte(' ')
+		}
+	}
+	return b.Bytes()
+}
+
+// fontTables returns data shaped like the glyf table of a TrueType font:
+// 4-byte aligned records of big-endian 16-bit fields.
+func fontTables() []byte {
+	rnd := rand.New(rand.NewSource(0))
+	var b bytes.Buffer
+	for i := 0; i < 2000; i++ {
+		n := 3 + rnd.Intn(12)
+		binary.Write(&b, binary.BigEndian, [5]int16{1, 0, -10, int16(400 + rnd.Intn(8)*50), 700})
+		binary.Write(&b, binary.BigEndian, [2]uint16{uint16(n - 1), 0})
+		for j := 0; j < n; j++ {
+			b.WriteByte([]byte{0x01, 0x33, 0x37, 0x21}[rnd.Intn(4)])
+		}
+		for j := 0; j < 2*n; j++ {
+			binary.Write(&b, binary.BigEndian, int16(rnd.Intn(16)*8-64))
+		}
+		for b.Len()%4 != 0 {
+			b.WriteByte(0)
+		}
+	}
+	return b.Bytes()
+}
+
+func TestWriterModeText(t *testing.T) {
+	text := utf8Text(100000)
+	font := fontTables()
+
+	params := encoderParams{quality: 11, mode: modeText}
+	if got := chooseContextMode(&params, font, 0, math.MaxUint32, uint(len(font))); got != contextUTF8 {
+		t.Errorf("ModeText context mode for binary data = %d, want contextUTF8", got)
+	}
+
+	generic, _ := encodeStream(text, WriterOptions{Quality: 11})
+	encoded, err := encodeStream(text, WriterOptions{Quality: 11, Mode: ModeText})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if err := checkCompressedData(encoded, text); err != nil {
+		t.Fatal(err)
+	}
+	// Sniffing already recognizes UTF-8 text, so the hint must not cost anything.
+	if len(encoded) > len(generic) {
+		t.Errorf("ModeText on UTF-8 text: %d bytes, ModeGeneric: %d bytes", len(encoded), len(generic))
+	}
+
+	// On binary data the hint overrides sniffing and changes the output.
+	generic, _ = encodeStream(font, WriterOptions{Quality: 11})
+	encoded, _ = encodeStream(font, WriterOptions{Quality: 11, Mode: ModeText})
+	if err := checkCompressedData(encoded, font); err != nil {
+		t.Fatal(err)
+	}
+	if len(encoded) == len(generic) {
+		t.Errorf("ModeText on binary data: %d bytes, same as ModeGeneric", len(encoded))
+	}
+	t.Logf("binary data: ModeGeneric %d bytes, ModeText %d bytes", len(generic), len(encoded))
+}
+
+func TestWriterModeFont(t *testing.T) {
+	font := fontTables()
+	for _, q := range []int{5, 9, 11} {
+		var sizes [2]int
+		for i, mode := range []Mode{ModeGeneric, ModeFont} {
+			var out bytes.Buffer
+			w := NewWriter(&out, WriterOptions{Quality: q, Mode: mode})
+			w.Write(font)
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			if err := checkCompressedData(out.Bytes(), font); err != nil {
+				t.Fatal(err)
+			}
+			sizes[i] = out.Len()
+
+			npostfix, ndirect := w.params.dist.distance_postfix_bits, w.params.dist.num_direct_distance_codes
+			if mode == ModeFont && (npostfix != 1 || ndirect != 12) {
+				t.Errorf("q=%d ModeFont: NPOSTFIX=%d NDIRECT=%d, want 1, 12", q, npostfix, ndirect)
+			}
+			if mode == ModeGeneric && (npostfix != 0 || ndirect != 0) {
+				t.Errorf("q=%d ModeGeneric: NPOSTFIX=%d NDIRECT=%d, want 0, 0", q, npostfix, ndirect)
+			}
+		}
+		if sizes[0] == sizes[1] {
+			t.Errorf("q=%d: ModeFont output has the same size as ModeGeneric (%d bytes)", q, sizes[0])
+		}
+		t.Logf("q=%d: ModeGeneric %d bytes, ModeFont %d bytes", q, sizes[0], sizes[1])
+	}
+}
+
+func TestLargeWindow(t *testing.T) {
+	// Keep the input within a single input block, so that the encoder does not
+	// allocate its full (up to 2 GiB) ring buffer.
+	input := utf8Text(10000)
+	for lgwin := 25; lgwin <= 30; lgwin++ {
+		for _, q := range []int{2, 3, 5, 9} {
+			encoded, err := encodeStream(input, WriterOptions{Quality: q, LGWin: lgwin, LargeWindow: true})
+			if err != nil {
+				t.Fatalf("lgwin=%d q=%d: Encode: %v", lgwin, q, err)
+			}
+			isLarge := encoded[0] == 0x11 && int(encoded[1]&0x3F) == lgwin
+			if q <= 2 {
+				// The fast qualities do not support large windows.
+				if isLarge {
+					t.Errorf("lgwin=%d q=%d: got large window header % x", lgwin, q, encoded[:2])
+				}
+			} else if !isLarge {
+				t.Errorf("lgwin=%d q=%d: header % x, want 11 %02x", lgwin, q, encoded[:2], lgwin)
+			}
+			decoded, err := ioutil.ReadAll(NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{LargeWindow: true}))
+			if err != nil {
+				t.Fatalf("lgwin=%d q=%d: decode: %v", lgwin, q, err)
+			}
+			if !bytes.Equal(decoded, input) {
+				t.Errorf("lgwin=%d q=%d: decoded %d bytes, want %d", lgwin, q, len(decoded), len(input))
+			}
+		}
+	}
+}
+
+func TestLargeWindowDistance(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping 17 MiB round trip in short mode")
+	}
+	// A block that repeats after more than 16 MiB can only be found with a
+	// large window.
+	const blockSize = 1 << 20
+	input := make([]byte, blockSize+(16<<20)+blockSize)
+	rand.New(rand.NewSource(0)).Read(input[:len(input)-blockSize])
+	copy(input[len(input)-blockSize:], input[:blockSize])
+
+	encoded, err := encodeStream(input, WriterOptions{Quality: 5, LGWin: 25, LargeWindow: true})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if len(encoded) > len(input)-blockSize/2 {
+		t.Errorf("Encode: %d bytes, want less than %d", len(encoded), len(input)-blockSize/2)
+	}
+	decoded, err := ioutil.ReadAll(NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{LargeWindow: true}))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !bytes.Equal(decoded, input) {
+		t.Errorf("decoded %d bytes, want %d", len(decoded), len(input))
+	}
+}
+
+func TestLargeWindowNotEnabled(t *testing.T) {
+	encoded, _ := encodeStream(utf8Text(1000), WriterOptions{Quality: 5, LGWin: 26, LargeWindow: true})
+	_, err := decodeStream(encoded)
+	if !errors.Is(err, errLargeWindow) {
+		t.Errorf("Decode of large window stream: got error %v, want %v", err, errLargeWindow)
+	}
+
+	// A large window Reader still decodes ordinary streams.
+	input := utf8Text(1000)
+	encoded, _ = encodeStream(input, WriterOptions{Quality: 5})
+	decoded, err := ioutil.ReadAll(NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{LargeWindow: true}))
+	if err != nil || !bytes.Equal(decoded, input) {
+		t.Errorf("large window Reader on ordinary stream: <%d bytes>, %v", len(decoded), err)
+	}
+}
+
+func TestWriterSizeHint(t *testing.T) {
+	input := utf8Text(2 << 20)[:2<<20]
+	for _, test := range []struct {
+		options    WriterOptions
+		wantHasher int
+	}{
+		// Without a hint, the first 4 KiB Write makes the encoder expect a small input.
+		{WriterOptions{Quality: 4}, 4},
+		{WriterOptions{Quality: 4, SizeHint: len(input)}, 54},
+		{WriterOptions{Quality: 6}, 5},
+		{WriterOptions{Quality: 6, SizeHint: len(input)}, 6},
+	} {
+		var out bytes.Buffer
+		w := NewWriter(&out, test.options)
+		for p := input; len(p) > 0; p = p[4096:] {
+			if _, err := w.Write(p[:4096]); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		if got := w.params.hasher.type_; got != test.wantHasher {
+			t.Errorf("%+v: hasher type %d, want %d", test.options, got, test.wantHasher)
+		}
+		if err := checkCompressedData(out.Bytes(), input); err != nil {
+			t.Errorf("%+v: %v", test.options, err)
+		}
+	}
+}
+
+func TestWriterSizeHintWindow(t *testing.T) {
+	for _, test := range []struct {
+		options WriterOptions
+		lgwin   uint
+	}{
+		{WriterOptions{Quality: 5}, defaultWindow},
+		{WriterOptions{Quality: 5, SizeHint: 1000}, 10},
+		{WriterOptions{Quality: 5, SizeHint: 1008}, 10},
+		{WriterOptions{Quality: 5, SizeHint: 1009}, 11},
+		{WriterOptions{Quality: 5, SizeHint: 100000}, 17},
+		{WriterOptions{Quality: 5, SizeHint: 100 << 20}, defaultWindow},
+		{WriterOptions{Quality: 5, SizeHint: 1000, LGWin: 20}, 20},
+	} {
+		w := NewWriter(ioutil.Discard, test.options)
+		if w.params.lgwin != test.lgwin {
+			t.Errorf("%+v: lgwin %d, want %d", test.options, w.params.lgwin, test.lgwin)
+		}
+	}
+
+	input := utf8Text(100000)
+	encoded, err := encodeStream(input, WriterOptions{Quality: 5, SizeHint: len(input)})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	// WBITS for a 17-bit window is the 7-bit code 0000001.
+	if encoded[0]&0x7F != 0x01 {
+		t.Errorf("stream header %#02x, want a 17-bit window", encoded[0]&0x7F)
+	}
+	if err := checkCompressedData(encoded, input); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriterLGBlock(t *testing.T) {
+	input := utf8Text(1 << 20)
+	for _, test := range []struct {
+		options WriterOptions
+		lgblock int
+	}{
+		{WriterOptions{Quality: 5}, 16},
+		{WriterOptions{Quality: 5, LGBlock: 20}, 20},
+		{WriterOptions{Quality: 5, LGBlock: 30}, maxInputBlockBits},
+		{WriterOptions{Quality: 9, LGWin: 22}, 18},
+		{WriterOptions{Quality: 9, LGWin: 22, LGBlock: 17}, 17},
+		{WriterOptions{Quality: 2, LGBlock: 20}, 14},
+	} {
+		var out bytes.Buffer
+		w := NewWriter(&out, test.options)
+		w.Write(input)
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		if w.params.lgblock != test.lgblock {
+			t.Errorf("%+v: lgblock %d, want %d", test.options, w.params.lgblock, test.lgblock)
+		}
+		if err := checkCompressedData(out.Bytes(), input); err != nil {
+			t.Errorf("%+v: %v", test.options, err)
+		}
+	}
+}
+
+func TestWriteMetadata(t *testing.T) {
+	first := utf8Text(50000)
+	second := bytes.Repeat([]byte("<html><body><H1>Hello world</H1></body></html>"), 100)
+	meta1 := []byte("record offset 50000; schema 7")
+	meta2 := make([]byte, 1000)
+	rand.New(rand.NewSource(0)).Read(meta2)
+	for _, q := range []int{0, 1, 2, 5, 11} {
+		var out bytes.Buffer
+		w := NewWriter(&out, WriterOptions{Quality: q})
+		w.Write(first)
+		if err := w.WriteMetadata(meta1); err != nil {
+			t.Fatalf("q=%d: WriteMetadata: %v", q, err)
+		}
+		if err := w.WriteMetadata(nil); err != nil {
+			t.Fatalf("q=%d: WriteMetadata(nil): %v", q, err)
+		}
+		w.Write(second)
+		w.Flush()
+		if err := w.WriteMetadata(meta2); err != nil {
+			t.Fatalf("q=%d: WriteMetadata: %v", q, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("q=%d: Close: %v", q, err)
+		}
+		// Metadata is stored byte-aligned and uncompressed.
+		if !bytes.Contains(out.Bytes(), meta1) || !bytes.Contains(out.Bytes(), meta2) {
+			t.Errorf("q=%d: metadata not found in the stream", q)
+		}
+		if err := checkCompressedData(out.Bytes(), append(append([]byte{}, first...), second...)); err != nil {
+			t.Errorf("q=%d: %v", q, err)
+		}
+		if err := w.WriteMetadata(meta1); err == nil {
+			t.Errorf("q=%d: WriteMetadata after Close: got nil error", q)
+		}
+	}
+}
+
+func TestWriteMetadataSplit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping 16 MiB metadata in short mode")
+	}
+	meta := make([]byte, maxMetadataBlockSize+10)
+	rand.New(rand.NewSource(0)).Read(meta)
+	var out bytes.Buffer
+	w := NewWriter(&out, WriterOptions{Quality: 5})
+	w.Write([]byte("hello"))
+	if err := w.WriteMetadata(meta); err != nil {
+		t.Fatalf("WriteMetadata: %v", err)
+	}
+	w.Write([]byte(" world"))
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	encoded := out.Bytes()
+	// The payload is split into a full block and a 10-byte one, each with
+	// its own header in between.
+	i := bytes.Index(encoded, meta[:maxMetadataBlockSize])
+	if i < 0 {
+		t.Fatalf("first metadata block not found")
+	}
+	rest := encoded[i+maxMetadataBlockSize:]
+	if j := bytes.Index(rest, meta[maxMetadataBlockSize:]); j <= 0 {
+		t.Errorf("second metadata block not found after its header")
+	}
+	if err := checkCompressedData(encoded, []byte("hello world")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	text := utf8Text(100000)
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(0)).Read(random)
+	meta := []byte("stats test")
+	for _, quality := range []int{0, 1, 5, 11} {
+		var out bytes.Buffer
+		w := NewWriter(&out, WriterOptions{Quality: quality, LGWin: 20})
+		w.Write(text)
+		if err := w.Flush(); err != nil {
+			t.Fatalf("quality %d: Flush: %v", quality, err)
+		}
+		w.WriteMetadata(meta)
+		w.Write(random)
+		if err := w.Close(); err != nil {
+			t.Fatalf("quality %d: Close: %v", quality, err)
+		}
+
+		ws := w.Stats()
+		if ws.BytesIn != int64(len(text)+len(random)) {
+			t.Errorf("quality %d: Writer BytesIn = %d, want %d", quality, ws.BytesIn, len(text)+len(random))
+		}
+		if ws.BytesOut != int64(out.Len()) {
+			t.Errorf("quality %d: Writer BytesOut = %d, want %d", quality, ws.BytesOut, out.Len())
+		}
+		if ws.Flushes != 1 {
+			t.Errorf("quality %d: Flushes = %d, want 1", quality, ws.Flushes)
+		}
+		if ws.CompressedMetablocks == 0 || ws.UncompressedMetablocks == 0 || ws.Metablocks != ws.CompressedMetablocks+ws.UncompressedMetablocks {
+			t.Errorf("quality %d: want both compressed and uncompressed metablocks, got %+v", quality, ws)
+		}
+
+		encoded := out.Bytes()
+		r := NewReader(bytes.NewReader(encoded))
+		decoded, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("quality %d: decode: %v", quality, err)
+		}
+		rs := r.Stats()
+		want := ReaderStats{
+			BytesIn:       int64(len(encoded)),
+			BytesOut:      int64(len(decoded)),
+			Metablocks:    rs.Metablocks,
+			WindowSize:    1 << 20,
+			MetadataBytes: int64(len(meta)),
+		}
+		if rs != want {
+			t.Errorf("quality %d: Reader stats = %+v, want %+v", quality, rs, want)
+		}
+		// Data metablocks, the metadata block, and possibly padding and a
+		// final empty block.
+		if rs.Metablocks < ws.Metablocks+1 {
+			t.Errorf("quality %d: Reader decoded %d metablocks, Writer wrote %d data metablocks", quality, rs.Metablocks, ws.Metablocks)
+		}
+
+		w.Reset(ioutil.Discard)
+		if ws := w.Stats(); ws != (WriterStats{}) {
+			t.Errorf("quality %d: stats after Reset = %+v", quality, ws)
+		}
+	}
+}
+
+func TestMetablockTrace(t *testing.T) {
+	input := utf8Text(300000)
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(0)).Read(random)
+	input = append(input, random...)
+	for _, quality := range []int{0, 1, 2, 3, 4, 5, 10, 11} {
+		var infos []MetablockInfo
+		var out bytes.Buffer
+		w := NewWriter(&out, WriterOptions{Quality: quality, MetablockTrace: func(info MetablockInfo) {
+			infos = append(infos, info)
+		}})
+		w.Write(input[:200000])
+		w.Flush()
+		w.Write(input[200000:])
+		if err := w.Close(); err != nil {
+			t.Fatalf("quality %d: Close: %v", quality, err)
+		}
+
+		stats := w.Stats()
+		if int64(len(infos)) != stats.Metablocks {
+			t.Errorf("quality %d: traced %d metablocks, Stats reports %d", quality, len(infos), stats.Metablocks)
+		}
+		var offset int64
+		var bits, uncompressed int
+		for _, info := range infos {
+			if info.Offset != offset {
+				t.Errorf("quality %d: metablock at offset %d, want %d", quality, info.Offset, offset)
+			}
+			offset += int64(info.InputSize)
+			bits += info.OutputBits
+			if info.Uncompressed {
+				uncompressed++
+			} else if info.LiteralHistograms == 0 || info.CommandHistograms == 0 || info.DistanceHistograms == 0 {
+				t.Errorf("quality %d: compressed metablock without prefix codes: %+v", quality, info)
+			}
+			switch {
+			case quality < 4:
+				if info.ContextMode != ContextNone {
+					t.Errorf("quality %d: metablock with context mode %v, want %v", quality, info.ContextMode, ContextNone)
+				}
+			case quality < 10:
+				if info.ContextMode != ContextUTF8 {
+					t.Errorf("quality %d: metablock with context mode %v, want %v", quality, info.ContextMode, ContextUTF8)
+				}
+			default:
+				if info.ContextMode == ContextNone {
+					t.Errorf("quality %d: metablock without a context mode", quality)
+				}
+			}
+		}
+		if offset != int64(len(input)) {
+			t.Errorf("quality %d: traced metablocks cover %d bytes, want %d", quality, offset, len(input))
+		}
+		if int64(uncompressed) != stats.UncompressedMetablocks {
+			t.Errorf("quality %d: traced %d uncompressed metablocks, Stats reports %d", quality, uncompressed, stats.UncompressedMetablocks)
+		}
+		// The stream header, padding and the final empty metablock are not
+		// part of any metablock.
+		if bits > 8*out.Len() || bits < 8*out.Len()-64 {
+			t.Errorf("quality %d: traced metablocks total %d bits, stream is %d bytes", quality, bits, out.Len())
+		}
+	}
+}
+
+func TestReaderMetadataCallback(t *testing.T) {
+	first := utf8Text(50000)
+	second := bytes.Repeat([]byte("<html><body><H1>Hello world</H1></body></html>"), 100)
+	meta1 := []byte("record offset 50000; schema 7")
+	meta2 := make([]byte, 1000)
+	rand.New(rand.NewSource(0)).Read(meta2)
+
+	var out bytes.Buffer
+	w := NewWriter(&out, WriterOptions{Quality: 5})
+	w.Write(first)
+	w.WriteMetadata(meta1)
+	w.Write(second)
+	w.Flush()
+	w.WriteMetadata(meta2)
+	w.Close()
+
+	type event struct {
+		offset    int64
+		payload   []byte
+		delivered int64 // bytes returned by Read before the call
+	}
+	var (
+		events    []event
+		delivered int64
+	)
+	r := NewReaderOptions(iotest.OneByteReader(bytes.NewReader(out.Bytes())), ReaderOptions{
+		MetadataCallback: func(offset int64, payload []byte) {
+			events = append(events, event{offset, append([]byte{}, payload...), delivered})
+		},
+	})
+	var decoded []byte
+	buf := make([]byte, 777)
+	for {
+		seen := len(events)
+		n, err := r.Read(buf)
+		decoded = append(decoded, buf[:n]...)
+		delivered += int64(n)
+		for _, e := range events[seen:] {
+			if e.delivered > e.offset || delivered < e.offset {
+				t.Errorf("metadata at offset %d reported during a Read covering [%d, %d)", e.offset, e.delivered, delivered)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+	if want := append(append([]byte{}, first...), second...); !bytes.Equal(decoded, want) {
+		t.Fatalf("decompressed data does not match")
+	}
+
+	want := []event{
+		{offset: int64(len(first)), payload: meta1},
+		{offset: int64(len(first) + len(second)), payload: meta2},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d metadata blocks, want %d", len(events), len(want))
+	}
+	for i, e := range events {
+		if e.offset != want[i].offset || !bytes.Equal(e.payload, want[i].payload) {
+			t.Errorf("metadata block %d: got offset %d, %d bytes; want offset %d, %d bytes", i, e.offset, len(e.payload), want[i].offset, len(want[i].payload))
+		}
+	}
+}
+
+func TestReaderMetadataMemoryLimit(t *testing.T) {
+	text := utf8Text(10000)
+	meta := make([]byte, 100000)
+	rand.New(rand.NewSource(0)).Read(meta)
+	var out bytes.Buffer
+	w := NewWriter(&out, WriterOptions{Quality: 5, LGWin: 16})
+	w.Write(text)
+	w.WriteMetadata(meta)
+	w.Write(text)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The payload only needs memory when it is kept for the callback.
+	r := NewReaderOptions(bytes.NewReader(out.Bytes()), ReaderOptions{MemoryLimit: 80000})
+	if decoded, err := ioutil.ReadAll(r); err != nil || len(decoded) != 2*len(text) {
+		t.Errorf("without a callback: got %d bytes, %v", len(decoded), err)
+	}
+
+	var payloads int
+	r = NewReaderOptions(bytes.NewReader(out.Bytes()), ReaderOptions{
+		MemoryLimit:      80000,
+		MetadataCallback: func(offset int64, payload []byte) { payloads++ },
+	})
+	_, err := ioutil.ReadAll(r)
+	var e *DecodeError
+	if !errors.Is(err, ErrMemoryLimit) || !errors.As(err, &e) || e.Code != ErrorAllocMetadata {
+		t.Errorf("with a callback: got error %v, want ErrorAllocMetadata", err)
+	}
+	if payloads != 0 {
+		t.Errorf("callback made %d times", payloads)
+	}
+
+	r = NewReaderOptions(bytes.NewReader(out.Bytes()), ReaderOptions{
+		MemoryLimit:      300000,
+		MetadataCallback: func(offset int64, payload []byte) { payloads++ },
+	})
+	if decoded, err := ioutil.ReadAll(r); err != nil || len(decoded) != 2*len(text) || payloads != 1 {
+		t.Errorf("with a callback and room for the payload: got %d bytes and %d payloads, %v", len(decoded), payloads, err)
+	}
+}
+
+func TestDictionary(t *testing.T) {
+	dict := []byte(`{"id":1234,"name":"Jane Doe","email":"jane.doe@example.com","roles":["admin","editor"],"active":true,"created_at":"2020-01-02T15:04:05Z"}`)
+	msg := []byte(`{"id":5678,"name":"John Roe","email":"john.roe@example.com","roles":["editor"],"active":false,"created_at":"2021-06-07T08:09:10Z"}`)
+	for q := 0; q < 12; q++ {
+		plain, _ := Encode(nil, msg, WriterOptions{Quality: q})
+		encoded, err := Encode(nil, msg, WriterOptions{Quality: q, Dictionary: dict})
+		if err != nil {
+			t.Fatalf("q=%d: Encode: %v", q, err)
+		}
+		if q >= 2 && len(encoded) >= len(plain) {
+			t.Errorf("q=%d: %d bytes with the dictionary, %d without", q, len(encoded), len(plain))
+		}
+		r := NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{Dictionary: dict})
+		decoded, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("q=%d: Read: %v", q, err)
+		}
+		if !bytes.Equal(decoded, msg) {
+			t.Errorf("q=%d: decompressed data does not match", q)
+		}
+		// Without the dictionary its references either fail to decode or
+		// are read as static dictionary words.
+		if q >= 2 {
+			if decoded, err := Decode(nil, encoded); err == nil && bytes.Equal(decoded, msg) {
+				t.Errorf("q=%d: decoded correctly without the dictionary", q)
+			}
+		}
+	}
+}
+
+func TestDictionaryBeyondWindow(t *testing.T) {
+	// The dictionary is much bigger than the window, and the input copies
+	// long runs from it, so copies span several ring buffer laps.
+	dict := make([]byte, 200000)
+	rand.New(rand.NewSource(1)).Read(dict)
+	var input []byte
+	for i := 0; i < 4; i++ {
+		input = append(input, dict[150000-i*40000:][:30000]...)
+		input = append(input, utf8Text(1000)...)
+	}
+	for _, q := range []int{2, 5, 9, 10, 11} {
+		var out bytes.Buffer
+		w := NewWriter(&out, WriterOptions{Quality: q, LGWin: 12, Dictionary: dict})
+		w.Write(input)
+		if err := w.Close(); err != nil {
+			t.Fatalf("q=%d: Close: %v", q, err)
+		}
+		if out.Len() > len(input)/4 {
+			t.Errorf("q=%d: %d bytes, the dictionary was not used", q, out.Len())
+		}
+		r := NewReaderOptions(iotest.OneByteReader(&out), ReaderOptions{Dictionary: dict})
+		decoded, err := ioutil.ReadAll(iotest.OneByteReader(r))
+		if err != nil {
+			t.Fatalf("q=%d: Read: %v", q, err)
+		}
+		if !bytes.Equal(decoded, input) {
+			t.Errorf("q=%d: decompressed data does not match", q)
+		}
+	}
+}
+
+func TestMaxDecodedSize(t *testing.T) {
+	// 64 MiB of zeros compress about ten thousand times.
+	bomb, _ := Encode(nil, make([]byte, 64<<20), WriterOptions{Quality: 5})
+	if len(bomb) > 10000 {
+		t.Fatalf("bomb is %d bytes", len(bomb))
+	}
+	for _, limit := range []int64{1, 1000, 1 << 16, 5<<20 + 3} {
+		r := NewReaderOptions(bytes.NewReader(bomb), ReaderOptions{MaxDecodedSize: limit})
+		n, err := io.Copy(ioutil.Discard, r)
+		if !errors.Is(err, ErrOutputLimit) {
+			t.Errorf("limit %d: got error %v, want ErrOutputLimit", limit, err)
+		}
+		if n != limit {
+			t.Errorf("limit %d: got %d bytes before the error", limit, n)
+		}
+		if _, err := r.Read(make([]byte, 10)); err == nil {
+			t.Errorf("limit %d: Read after ErrOutputLimit succeeded", limit)
+		}
+	}
+
+	// Streams that fit the limit are unaffected, including one that meets
+	// it exactly.
+	content := bytes.Repeat([]byte("hello world!"), 10000)
+	encoded, _ := Encode(nil, content, WriterOptions{Quality: 5})
+	for _, limit := range []int64{int64(len(content)), int64(len(content)) + 1} {
+		r := NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{MaxDecodedSize: limit})
+		decoded, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("limit %d: %v", limit, err)
+		}
+		if !bytes.Equal(decoded, content) {
+			t.Errorf("limit %d: decompressed data does not match", limit)
+		}
+	}
+	r := NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{MaxDecodedSize: int64(len(content)) - 1})
+	if _, err := ioutil.ReadAll(r); !errors.Is(err, ErrOutputLimit) {
+		t.Errorf("limit one byte short: got error %v, want ErrOutputLimit", err)
+	}
+}
+
+func TestMaxWindowBits(t *testing.T) {
+	content := utf8Text(100000)
+	encoded, _ := Encode(nil, content, WriterOptions{Quality: 5, LGWin: 22})
+	r := NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{MaxWindowBits: 21})
+	if _, err := ioutil.ReadAll(r); !errors.Is(err, ErrMemoryLimit) {
+		t.Errorf("MaxWindowBits 21: got error %v, want ErrMemoryLimit", err)
+	}
+	r = NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{MaxWindowBits: 22})
+	decoded, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Errorf("MaxWindowBits 22: %v", err)
+	}
+	if !bytes.Equal(decoded, content) {
+		t.Errorf("MaxWindowBits 22: decompressed data does not match")
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	small := []byte("<html><body><H1>Hello world</H1></body></html>")
+	large := utf8Text(3 << 20)
+	encodedSmall, _ := Encode(nil, small, WriterOptions{Quality: 5, LGWin: 22})
+	encodedLarge, _ := Encode(nil, large, WriterOptions{Quality: 5, LGWin: 22})
+	for _, test := range []struct {
+		encoded []byte
+		want    []byte
+		options ReaderOptions
+		err     error
+	}{
+		{encodedSmall, small, ReaderOptions{MemoryLimit: 64 << 10}, nil},
+		// The block type trees alone take 12 KiB.
+		{encodedSmall, nil, ReaderOptions{MemoryLimit: 12 << 10}, ErrMemoryLimit},
+		{encodedLarge, large, ReaderOptions{MemoryLimit: 8 << 20}, nil},
+		{encodedLarge, nil, ReaderOptions{MemoryLimit: 1 << 20}, ErrMemoryLimit},
+		// Allocating the whole window up front takes 4 MiB even for a
+		// short stream.
+		{encodedSmall, small, ReaderOptions{MemoryLimit: 8 << 20, DisableRingBufferReallocation: true}, nil},
+		{encodedSmall, nil, ReaderOptions{MemoryLimit: 64 << 10, DisableRingBufferReallocation: true}, ErrMemoryLimit},
+	} {
+		r := NewReaderOptions(bytes.NewReader(test.encoded), test.options)
+		decoded, err := ioutil.ReadAll(r)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%+v: got error %v, want %v", test.options, err, test.err)
+			continue
+		}
+		if err == nil && !bytes.Equal(decoded, test.want) {
+			t.Errorf("%+v: decompressed data does not match", test.options)
+		}
+		if err != nil && len(decoded) != 0 {
+			t.Errorf("%+v: got %d bytes before the error", test.options, len(decoded))
+		}
+	}
+}
+
+func TestMemoryLimitWindowGrowth(t *testing.T) {
+	// The flush makes the decoder start with a small window and grow it
+	// later; while it grows, the old and the new window both count.
+	input := utf8Text(3 << 20)
+	var buf bytes.Buffer
+	w := NewWriter(&buf, WriterOptions{Quality: 5, LGWin: 22})
+	w.Write(input[:100<<10])
+	w.Flush()
+	w.Write(input[100<<10:])
+	w.Close()
+	for _, test := range []struct {
+		limit int64
+		err   error
+	}{
+		{4<<20 + 256<<10, nil},
+		{4<<20 + 64<<10, ErrMemoryLimit},
+	} {
+		r := NewReaderOptions(bytes.NewReader(buf.Bytes()), ReaderOptions{MemoryLimit: test.limit})
+		decoded, err := ioutil.ReadAll(r)
+		if !errors.Is(err, test.err) {
+			t.Errorf("MemoryLimit %d: got error %v, want %v", test.limit, err, test.err)
+			continue
+		}
+		if err == nil && !bytes.Equal(decoded, input) {
+			t.Errorf("MemoryLimit %d: decompressed data does not match", test.limit)
+		}
+	}
+}
+
 type readerWithTimeout struct {
 	io.Reader
 }
@@ -252,7 +1092,7 @@ func TestDecoderStreaming(t *testing.T) {
 
 func TestReader(t *testing.T) {
 	content := bytes.Repeat([]byte("hello world!"), 10000)
-	encoded, _ := Encode(content, WriterOptions{Quality: 5})
+	encoded, _ := encodeStream(content, WriterOptions{Quality: 5})
 	r := NewReader(bytes.NewReader(encoded))
 	var decodedOutput bytes.Buffer
 	n, err := io.Copy(&decodedOutput, r)
@@ -269,16 +1109,115 @@ func TestReader(t *testing.T) {
 	}
 }
 
-func TestDecode(t *testing.T) {
-	content := bytes.Repeat([]byte("hello world!"), 10000)
-	encoded, _ := Encode(content, WriterOptions{Quality: 5})
-	decoded, err := Decode(encoded)
+func TestReaderWriteTo(t *testing.T) {
+	content := utf8Text(1 << 20)
+	encoded, _ := Encode(nil, content, WriterOptions{Quality: 5, LGWin: 16})
+	r := NewReader(iotest.HalfReader(bytes.NewReader(encoded)))
+	var decoded bytes.Buffer
+	n, err := r.WriteTo(&decoded)
 	if err != nil {
-		t.Errorf("Decode: %v", err)
+		t.Fatalf("WriteTo: %v", err)
 	}
-	if !bytes.Equal(decoded, content) {
-		t.Errorf(""+
-			"Decode content:\n"+
+	if n != int64(len(content)) || !bytes.Equal(decoded.Bytes(), content) {
+		t.Errorf("WriteTo wrote %d bytes, want %d matching the input", n, len(content))
+	}
+	if got := r.Stats().BytesIn; got != int64(len(encoded)) {
+		t.Errorf("BytesIn = %d, want %d", got, len(encoded))
+	}
+
+	r = NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{MaxDecodedSize: 100000})
+	decoded.Reset()
+	n, err = r.WriteTo(&decoded)
+	if !errors.Is(err, ErrOutputLimit) {
+		t.Errorf("MaxDecodedSize: got error %v, want ErrOutputLimit", err)
+	}
+	if n != 100000 || !bytes.Equal(decoded.Bytes(), content[:n]) {
+		t.Errorf("MaxDecodedSize: WriteTo wrote %d bytes, want the first 100000", n)
+	}
+
+	r = NewReader(bytes.NewReader(encoded[:len(encoded)/2]))
+	if _, err := r.WriteTo(ioutil.Discard); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated input: got error %v, want io.ErrUnexpectedEOF", err)
+	}
+
+	// Empty input ends like it does for Read.
+	r = NewReader(bytes.NewReader(nil))
+	if _, err := r.Read(make([]byte, 10)); err != io.EOF {
+		t.Errorf("empty input: Read returned %v, want io.EOF", err)
+	}
+	r = NewReader(bytes.NewReader(nil))
+	if n, err := r.WriteTo(ioutil.Discard); n != 0 || err != nil {
+		t.Errorf("empty input: WriteTo returned %d, %v, want 0, nil", n, err)
+	}
+
+	r = NewReader(emptyReader{})
+	if _, err := r.WriteTo(ioutil.Discard); err != io.ErrNoProgress {
+		t.Errorf("source without progress: got error %v, want io.ErrNoProgress", err)
+	}
+}
+
+// emptyReader is a source that always returns 0 bytes and no error.
+type emptyReader struct{}
+
+func (emptyReader) Read(p []byte) (int, error) {
+	return 0, nil
+}
+
+func TestWriterReadFrom(t *testing.T) {
+	content := utf8Text(1 << 20)
+	for _, quality := range []int{0, 1, 5, 11} {
+		var got bytes.Buffer
+		w := NewWriter(&got, WriterOptions{Quality: quality, LGWin: 18})
+		n, err := w.ReadFrom(iotest.HalfReader(bytes.NewReader(content)))
+		if err != nil {
+			t.Fatalf("quality %d: ReadFrom: %v", quality, err)
+		}
+		if n != int64(len(content)) {
+			t.Errorf("quality %d: ReadFrom read %d bytes, want %d", quality, n, len(content))
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("quality %d: Close: %v", quality, err)
+		}
+		if got := w.Stats().BytesIn; got != int64(len(content)) {
+			t.Errorf("quality %d: BytesIn = %d, want %d", quality, got, len(content))
+		}
+		if err := checkCompressedData(got.Bytes(), content); err != nil {
+			t.Errorf("quality %d: %v", quality, err)
+		}
+	}
+
+	// Small inputs only take a small ring buffer, as with Write, and give
+	// the same output.
+	for _, size := range []int{12, 1000, 1 << 16, 1<<16 + 1} {
+		options := WriterOptions{Quality: 5, LGWin: 22}
+		want, _ := encodeStream(content[:size], options)
+		var got bytes.Buffer
+		w := NewWriter(&got, options)
+		if _, err := w.ReadFrom(iotest.HalfReader(bytes.NewReader(content[:size]))); err != nil {
+			t.Fatalf("%d bytes: ReadFrom: %v", size, err)
+		}
+		if size < 1<<16 && cap(w.ringbuffer_.data_) >= 1<<17 {
+			t.Errorf("%d bytes: ReadFrom allocated a ring buffer of %d bytes", size, cap(w.ringbuffer_.data_))
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%d bytes: Close: %v", size, err)
+		}
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Errorf("%d bytes: ReadFrom wrote %d bytes, Write %d", size, got.Len(), len(want))
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	content := bytes.Repeat([]byte("hello world!"), 10000)
+	encoded, _ := encodeStream(content, WriterOptions{Quality: 5})
+	decoded, err := decodeStream(encoded)
+	if err != nil {
+		t.Errorf("Decode: %v", err)
+	}
+	if !bytes.Equal(decoded, content) {
+		t.Errorf(""+
+			"Decode content:\n"+
 			"%q\n"+
 			"want:\n"+
 			"<%d bytes>",
@@ -286,11 +1225,90 @@ func TestDecode(t *testing.T) {
 	}
 }
 
+func TestEncodeAppend(t *testing.T) {
+	content := bytes.Repeat([]byte("hello world!"), 10000)
+	prefix := []byte("prefix")
+	for q := 0; q < 12; q++ {
+		encoded, err := Encode(append([]byte{}, prefix...), content, WriterOptions{Quality: q})
+		if err != nil {
+			t.Fatalf("q=%d: Encode: %v", q, err)
+		}
+		if !bytes.HasPrefix(encoded, prefix) {
+			t.Fatalf("q=%d: Encode did not append to dst", q)
+		}
+		if err := checkCompressedData(encoded[len(prefix):], content); err != nil {
+			t.Errorf("q=%d: %v", q, err)
+		}
+		decoded, err := Decode(append([]byte{}, prefix...), encoded[len(prefix):])
+		if err != nil {
+			t.Fatalf("q=%d: Decode: %v", q, err)
+		}
+		if !bytes.Equal(decoded[len(prefix):], content) || !bytes.HasPrefix(decoded, prefix) {
+			t.Errorf("q=%d: Decode did not append the content to dst", q)
+		}
+	}
+}
+
+func TestEncodeIncompressible(t *testing.T) {
+	for _, n := range []int{0, 1, 100, 1 << 16, 1<<16 + 1, 1<<20 + 1} {
+		content := make([]byte, n)
+		rand.New(rand.NewSource(int64(n))).Read(content)
+		for _, q := range []int{0, 5, 11} {
+			encoded, err := Encode(nil, content, WriterOptions{Quality: q})
+			if err != nil {
+				t.Fatalf("n=%d q=%d: Encode: %v", n, q, err)
+			}
+			if len(encoded) > MaxCompressedSize(n) {
+				t.Errorf("n=%d q=%d: got %d bytes, MaxCompressedSize is %d", n, q, len(encoded), MaxCompressedSize(n))
+			}
+			decoded, err := Decode(nil, encoded)
+			if err != nil {
+				t.Fatalf("n=%d q=%d: Decode: %v", n, q, err)
+			}
+			if !bytes.Equal(decoded, content) {
+				t.Errorf("n=%d q=%d: decompressed data does not match", n, q)
+			}
+		}
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	content := bytes.Repeat([]byte("hello world!"), 100)
+	encoded, _ := Encode(nil, content, WriterOptions{Quality: 5})
+	if _, err := Decode(nil, encoded[:len(encoded)-1]); err != io.ErrUnexpectedEOF {
+		t.Errorf("Decode of a truncated stream: got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestEncodeDecodeOneShot(t *testing.T) {
+	content := utf8Text(100000)
+	for q := 0; q < 12; q++ {
+		options := WriterOptions{Quality: q, LGWin: 18}
+		encoded, err := Encode(nil, content, options)
+		if err != nil {
+			t.Fatalf("q=%d: Encode: %v", q, err)
+		}
+		streamed, err := encodeStream(content, options)
+		if err != nil {
+			t.Fatalf("q=%d: Writer: %v", q, err)
+		}
+		if !bytes.Equal(encoded, streamed) {
+			t.Errorf("q=%d: Encode wrote %d bytes, the Writer %d", q, len(encoded), len(streamed))
+		}
+		if decoded, err := decodeStream(encoded); err != nil || !bytes.Equal(decoded, content) {
+			t.Errorf("q=%d: Reader on the output of Encode: <%d bytes>, %v", q, len(decoded), err)
+		}
+		if decoded, err := Decode(nil, streamed); err != nil || !bytes.Equal(decoded, content) {
+			t.Errorf("q=%d: Decode on the output of the Writer: <%d bytes>, %v", q, len(decoded), err)
+		}
+	}
+}
+
 func TestQuality(t *testing.T) {
 	content := bytes.Repeat([]byte("hello world!"), 10000)
 	for q := 0; q < 12; q++ {
-		encoded, _ := Encode(content, WriterOptions{Quality: q})
-		decoded, err := Decode(encoded)
+		encoded, _ := encodeStream(content, WriterOptions{Quality: q})
+		decoded, err := decodeStream(encoded)
 		if err != nil {
 			t.Errorf("Decode: %v", err)
 		}
@@ -309,7 +1327,7 @@ func TestDecodeFuzz(t *testing.T) {
 	// Test that the decoder terminates with corrupted input.
 	content := bytes.Repeat([]byte("hello world!"), 100)
 	src := rand.NewSource(0)
-	encoded, err := Encode(content, WriterOptions{Quality: 5})
+	encoded, err := encodeStream(content, WriterOptions{Quality: 5})
 	if err != nil {
 		t.Fatalf("Encode(<%d bytes>, _) = _, %s", len(content), err)
 	}
@@ -321,19 +1339,177 @@ func TestDecodeFuzz(t *testing.T) {
 		for j := 0; j < 5; j++ {
 			enc[int(src.Int63())%len(enc)] = byte(src.Int63() % 256)
 		}
-		Decode(enc)
+		decodeStream(enc)
 	}
 }
 
+func TestDecodeErrorPosition(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, WriterOptions{Quality: 5})
+	w.Write([]byte("hello, world"))
+	w.Flush()
+	// A metadata metablock header with its reserved bit set: ISLAST = 1,
+	// ISLASTEMPTY = 0, MNIBBLES = 0 (11), reserved = 1.
+	corrupt := append(buf.Bytes(), 0x1d, 0)
+
+	check := func(name string, err error) {
+		var e *DecodeError
+		if !errors.As(err, &e) {
+			t.Fatalf("%s: got error %v, want a *DecodeError", name, err)
+		}
+		if !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: error does not match ErrCorrupt", name)
+		}
+		if e.Code != ErrorFormatReserved {
+			t.Errorf("%s: got code %v, want %v", name, e.Code, ErrorFormatReserved)
+		}
+		if e.Offset != int64(buf.Len()) || e.Bit != 5 {
+			t.Errorf("%s: got position byte %d bit %d, want byte %d bit 5", name, e.Offset, e.Bit, buf.Len())
+		}
+		if e.OutputOffset != 12 {
+			t.Errorf("%s: got output offset %d, want 12", name, e.OutputOffset)
+		}
+		if e.Metablock == 0 {
+			t.Errorf("%s: got metablock 0, want a later one", name)
+		}
+	}
+
+	_, err := Decode(nil, corrupt)
+	check("Decode", err)
+	_, err = ioutil.ReadAll(NewReader(bytes.NewReader(corrupt)))
+	check("Reader", err)
+	// Byte by byte, the decoder reads through its internal buffer.
+	_, err = ioutil.ReadAll(NewReader(iotest.OneByteReader(bytes.NewReader(corrupt))))
+	check("Reader, one byte at a time", err)
+}
+
 func TestDecodeTrailingData(t *testing.T) {
 	content := bytes.Repeat([]byte("hello world!"), 100)
-	encoded, _ := Encode(content, WriterOptions{Quality: 5})
-	_, err := Decode(append(encoded, 0))
+	encoded, _ := encodeStream(content, WriterOptions{Quality: 5})
+	_, err := decodeStream(append(encoded, 0))
 	if err == nil {
 		t.Errorf("Expected 'excessive input' error")
 	}
 }
 
+func TestStopAtStreamEnd(t *testing.T) {
+	content := utf8Text(100000)
+	encoded, _ := Encode(nil, content, WriterOptions{Quality: 5})
+	trailer := []byte("next record")
+	input := append(append([]byte{}, encoded...), trailer...)
+
+	r := NewReader(bytes.NewReader(input))
+	if _, err := ioutil.ReadAll(r); err != errExcessiveInput {
+		t.Errorf("without StopAtStreamEnd: got error %v, want errExcessiveInput", err)
+	}
+
+	options := ReaderOptions{StopAtStreamEnd: true}
+	for _, test := range []struct {
+		name string
+		src  io.Reader
+		rest func() []byte
+	}{
+		{"io.Reader", struct{ io.Reader }{bytes.NewReader(input)}, nil},
+		{"io.ByteReader", bytes.NewReader(input), nil},
+		{"bufio.Reader", bufio.NewReaderSize(bytes.NewReader(input), 4096), nil},
+	} {
+		r := NewReaderOptions(test.src, options)
+		decoded, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("%s: ReadAll: %v", test.name, err)
+		}
+		if !bytes.Equal(decoded, content) {
+			t.Errorf("%s: decompressed data does not match", test.name)
+		}
+		if got := r.Stats().BytesIn; got != int64(len(encoded)) {
+			t.Errorf("%s: BytesIn = %d, want %d", test.name, got, len(encoded))
+		}
+		// Whatever the Reader did not take from the source must still be
+		// there.
+		rest, _ := ioutil.ReadAll(test.src)
+		if got := append(r.Unread(), rest...); !bytes.Equal(got, trailer) {
+			t.Errorf("%s: data after the stream = %q, want %q", test.name, got, trailer)
+		}
+		if _, ok := test.src.(io.ByteReader); ok && len(r.Unread()) != 0 {
+			t.Errorf("%s: Reader read %d bytes past the end of the stream", test.name, len(r.Unread()))
+		}
+	}
+
+	br := bufio.NewReader(bytes.NewReader(input))
+	r = NewReaderOptions(br, options)
+	var decoded bytes.Buffer
+	if _, err := r.WriteTo(&decoded); err != nil {
+		t.Errorf("WriteTo: %v", err)
+	}
+	if rest, _ := ioutil.ReadAll(br); !bytes.Equal(decoded.Bytes(), content) || !bytes.Equal(rest, trailer) {
+		t.Errorf("WriteTo: decoded %d bytes and left %q", decoded.Len(), rest)
+	}
+}
+
+func TestMultistream(t *testing.T) {
+	first := utf8Text(100000)
+	second := bytes.Repeat([]byte("<html><body><H1>Hello world</H1></body></html>"), 1000)
+	a, _ := Encode(nil, first, WriterOptions{Quality: 5, LGWin: 16})
+	b, _ := Encode(nil, second, WriterOptions{Quality: 5, LGWin: 20})
+	input := append(append([]byte{}, a...), b...)
+	want := append(append([]byte{}, first...), second...)
+
+	r := NewReader(bytes.NewReader(input))
+	r.Multistream(true)
+	decoded, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Errorf("Read: %v", err)
+	}
+	if !bytes.Equal(decoded, want) {
+		t.Errorf("Read: decompressed data does not match")
+	}
+
+	r.Reset(bytes.NewReader(input))
+	r.Multistream(true)
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Errorf("WriteTo: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("WriteTo: decompressed data does not match")
+	}
+
+	r.Reset(bytes.NewReader(input[:len(input)-10]))
+	r.Multistream(true)
+	if _, err := ioutil.ReadAll(r); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated second stream: got error %v, want io.ErrUnexpectedEOF", err)
+	}
+
+	// One stream at a time.
+	r = NewReaderOptions(bufio.NewReader(bytes.NewReader(input)), ReaderOptions{StopAtStreamEnd: true})
+	for i, test := range []struct {
+		content    []byte
+		windowSize int64
+	}{
+		{first, 1 << 16},
+		{second, 1 << 20},
+	} {
+		if i > 0 {
+			if err := r.NextStream(); err != nil {
+				t.Fatalf("stream %d: NextStream: %v", i, err)
+			}
+		}
+		decoded, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("stream %d: Read: %v", i, err)
+		}
+		if !bytes.Equal(decoded, test.content) {
+			t.Errorf("stream %d: decompressed data does not match", i)
+		}
+		if got := r.Stats().WindowSize; got != test.windowSize {
+			t.Errorf("stream %d: WindowSize = %d, want %d", i, got, test.windowSize)
+		}
+	}
+	if err := r.NextStream(); err != io.EOF {
+		t.Errorf("NextStream after the last stream: got %v, want io.EOF", err)
+	}
+}
+
 func TestEncodeDecode(t *testing.T) {
 	for _, test := range []struct {
 		data    []byte
@@ -346,7 +1522,7 @@ func TestEncodeDecode(t *testing.T) {
 	} {
 		t.Logf("case %q x %d", test.data, test.repeats)
 		input := bytes.Repeat(test.data, test.repeats)
-		encoded, err := Encode(input, WriterOptions{Quality: 5})
+		encoded, err := encodeStream(input, WriterOptions{Quality: 5})
 		if err != nil {
 			t.Errorf("Encode: %v", err)
 		}
@@ -357,7 +1533,7 @@ func TestEncodeDecode(t *testing.T) {
 				"Encoded=%q",
 				len(encoded), maxSize, encoded)
 		}
-		decoded, err := Decode(encoded)
+		decoded, err := decodeStream(encoded)
 		if err != nil {
 			t.Errorf("Decode: %v", err)
 		}
@@ -378,8 +1554,1058 @@ func TestEncodeDecode(t *testing.T) {
 	}
 }
 
-// Encode returns content encoded with Brotli.
-func Encode(content []byte, options WriterOptions) ([]byte, error) {
+func TestParallelWriter(t *testing.T) {
+	input := utf8Text(400000)
+	random := make([]byte, 50000)
+	rand.New(rand.NewSource(0)).Read(random)
+	input = append(input, random...)
+	input = append(input, bytes.Repeat([]byte("<html><body><H1>Hello world</H1></body></html>"), 2000)...)
+	for _, quality := range []int{0, 1, 2, 5, 9, 11} {
+		data := input
+		if quality == 11 {
+			data = input[:150000]
+		}
+		options := WriterOptions{Quality: quality, LGWin: 18, ChunkSize: 64 << 10, Concurrency: 1}
+		var sequential bytes.Buffer
+		w := NewWriter(&sequential, options)
+		for i := 0; i < len(data); i += 10000 {
+			end := i + 10000
+			if end > len(data) {
+				end = len(data)
+			}
+			w.Write(data[i:end])
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("quality %d: Close: %v", quality, err)
+		}
+		if err := checkCompressedData(sequential.Bytes(), data); err != nil {
+			t.Fatalf("quality %d: %v", quality, err)
+		}
+
+		options.Concurrency = 8
+		var concurrent bytes.Buffer
+		w = NewWriter(&concurrent, options)
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			t.Fatalf("quality %d: Close: %v", quality, err)
+		}
+		if !bytes.Equal(concurrent.Bytes(), sequential.Bytes()) {
+			t.Errorf("quality %d: output depends on Concurrency", quality)
+		}
+		encoded, err := Encode(nil, data, options)
+		if err != nil {
+			t.Fatalf("quality %d: Encode: %v", quality, err)
+		}
+		if err := checkCompressedData(encoded, data); err != nil {
+			t.Errorf("quality %d: Encode: %v", quality, err)
+		}
+
+		if stats := w.Stats(); stats.BytesIn != int64(len(data)) || stats.BytesOut != int64(concurrent.Len()) {
+			t.Errorf("quality %d: Stats reports %d bytes in and %d out, want %d and %d", quality, stats.BytesIn, stats.BytesOut, len(data), concurrent.Len())
+		}
+		t.Logf("quality %d: %d bytes in %d chunks, %d bytes compressed", quality, len(data), (len(data)+options.ChunkSize-1)/options.ChunkSize, concurrent.Len())
+	}
+}
+
+func TestParallelWriterDictionary(t *testing.T) {
+	dict := utf8Text(20000)
+	input := utf8Text(300000)
+	for _, quality := range []int{2, 5, 10} {
+		options := WriterOptions{Quality: quality, Dictionary: dict, ChunkSize: 32 << 10}
+		var out bytes.Buffer
+		w := NewWriter(&out, options)
+		w.Write(input)
+		if err := w.Close(); err != nil {
+			t.Fatalf("quality %d: Close: %v", quality, err)
+		}
+		decoded, err := ioutil.ReadAll(NewReaderOptions(&out, ReaderOptions{Dictionary: dict}))
+		if err != nil {
+			t.Fatalf("quality %d: decoding: %v", quality, err)
+		}
+		if !bytes.Equal(decoded, input) {
+			t.Errorf("quality %d: decoded data does not match the input", quality)
+		}
+	}
+}
+
+func TestParallelWriterFlush(t *testing.T) {
+	input := utf8Text(200000)
+	var infos []MetablockInfo
+	var out bytes.Buffer
+	w := NewWriter(&out, WriterOptions{Quality: 5, ChunkSize: 50000, MetablockTrace: func(info MetablockInfo) {
+		infos = append(infos, info)
+	}})
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteMetadata([]byte("start")); err != nil {
+		t.Fatal(err)
+	}
+	w.Write(input[:70000])
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCompressedData(append(append([]byte(nil), out.Bytes()...), 3), input[:70000]); err != nil {
+		t.Fatalf("after Flush: %v", err)
+	}
+	w.Write(input[70000:100000])
+	if err := w.WriteMetadata([]byte("middle")); err != nil {
+		t.Fatal(err)
+	}
+	w.Write(input[100000:])
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(input); err != errWriterClosed {
+		t.Errorf("Write after Close returned %v, want %v", err, errWriterClosed)
+	}
+
+	var metadata []string
+	r := NewReaderOptions(&out, ReaderOptions{MetadataCallback: func(offset int64, m []byte) {
+		metadata = append(metadata, string(m))
+	}})
+	decoded, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("decoding: %v", err)
+	}
+	if !bytes.Equal(decoded, input) {
+		t.Errorf("decoded data does not match the input")
+	}
+	if fmt.Sprint(metadata) != "[start middle]" {
+		t.Errorf("got metadata %q, want [start middle]", metadata)
+	}
+
+	var offset int64
+	for _, info := range infos {
+		if info.Offset != offset {
+			t.Errorf("metablock at offset %d, want %d", info.Offset, offset)
+		}
+		offset += int64(info.InputSize)
+	}
+	if offset != int64(len(input)) {
+		t.Errorf("traced metablocks cover %d bytes, want %d", offset, len(input))
+	}
+	if stats := w.Stats(); int64(len(infos)) != stats.Metablocks || stats.Flushes != 2 {
+		t.Errorf("traced %d metablocks and 2 flushes, Stats reports %+v", len(infos), stats)
+	}
+}
+
+func TestParallelWriterEmpty(t *testing.T) {
+	for _, quality := range []int{0, 5, 11} {
+		var out bytes.Buffer
+		w := NewWriter(&out, WriterOptions{Quality: quality, ChunkSize: 1 << 20})
+		if err := w.Close(); err != nil {
+			t.Fatalf("quality %d: Close: %v", quality, err)
+		}
+		if err := checkCompressedData(out.Bytes(), nil); err != nil {
+			t.Errorf("quality %d: %v", quality, err)
+		}
+	}
+}
+
+func TestSeekable(t *testing.T) {
+	input := utf8Text(300000)
+	random := make([]byte, 40000)
+	rand.New(rand.NewSource(0)).Read(random)
+	input = append(input, random...)
+	input = append(input, utf8Text(100000)...)
+	dict := utf8Text(10000)
+	for _, options := range []WriterOptions{
+		{Quality: 1, LGWin: 18, ChunkSize: 50000},
+		{Quality: 5, LGWin: 18, ChunkSize: 64 << 10},
+		{Quality: 5, LGWin: 16, ChunkSize: 100000},
+		{Quality: 9, LGWin: 18, ChunkSize: 30000, Dictionary: dict},
+		{Quality: 11, LGWin: 18, ChunkSize: 64 << 10},
+	} {
+		var out bytes.Buffer
+		w := NewSeekableWriter(&out, options)
+		w.Write(input[:12345])
+		if err := w.Flush(); err != nil {
+			t.Fatalf("%+v: Flush: %v", options, err)
+		}
+		w.Write(input[12345:])
+		if err := w.Close(); err != nil {
+			t.Fatalf("%+v: Close: %v", options, err)
+		}
+
+		decoded, err := ioutil.ReadAll(NewReaderOptions(bytes.NewReader(out.Bytes()), ReaderOptions{Dictionary: options.Dictionary}))
+		if err != nil {
+			t.Fatalf("%+v: decoding the whole stream: %v", options, err)
+		}
+		if !bytes.Equal(decoded, input) {
+			t.Fatalf("%+v: decoded stream does not match the input", options)
+		}
+
+		r, err := NewSeekableReader(bytes.NewReader(out.Bytes()), int64(out.Len()), ReaderOptions{Dictionary: options.Dictionary})
+		if err != nil {
+			t.Fatalf("%+v: NewSeekableReader: %v", options, err)
+		}
+		if r.Size() != int64(len(input)) {
+			t.Errorf("%+v: Size is %d, want %d", options, r.Size(), len(input))
+		}
+		rnd := rand.New(rand.NewSource(1))
+		for i := 0; i < 50; i++ {
+			off := rnd.Intn(len(input))
+			p := make([]byte, rnd.Intn(100000))
+			n, err := r.ReadAt(p, int64(off))
+			want := input[off:]
+			if len(want) > len(p) {
+				want = want[:len(p)]
+			}
+			if n != len(want) || !bytes.Equal(p[:n], want) {
+				t.Fatalf("%+v: ReadAt(%d bytes, %d) returned the wrong data", options, len(p), off)
+			}
+			if (n < len(p)) != (err == io.EOF) || (err != nil && err != io.EOF) {
+				t.Fatalf("%+v: ReadAt(%d bytes, %d) returned %d, %v", options, len(p), off, n, err)
+			}
+		}
+
+		if _, err := r.Seek(-1000, io.SeekEnd); err != nil {
+			t.Fatal(err)
+		}
+		tail, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(tail, input[len(input)-1000:]) {
+			t.Errorf("%+v: reading after Seek returned %d bytes, %v", options, len(tail), err)
+		}
+	}
+}
+
+func TestSeekableEmpty(t *testing.T) {
+	var out bytes.Buffer
+	w := NewSeekableWriter(&out, WriterOptions{Quality: 5})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCompressedData(out.Bytes(), nil); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewSeekableReader(bytes.NewReader(out.Bytes()), int64(out.Len()), ReaderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := r.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Errorf("Read returned %d, %v, want 0, EOF", n, err)
+	}
+}
+
+func TestSeekableErrors(t *testing.T) {
+	input := utf8Text(100000)
+	plain, _ := Encode(nil, input, WriterOptions{Quality: 5})
+	if _, err := NewSeekableReader(bytes.NewReader(plain), int64(len(plain)), ReaderOptions{}); err != ErrNoSeekTable {
+		t.Errorf("NewSeekableReader on a plain stream returned %v, want %v", err, ErrNoSeekTable)
+	}
+
+	var out bytes.Buffer
+	w := NewSeekableWriter(&out, WriterOptions{Quality: 5, ChunkSize: 20000})
+	w.Write(input)
+	w.Close()
+	corrupt := append([]byte(nil), out.Bytes()...)
+	r, err := NewSeekableReader(bytes.NewReader(corrupt), int64(len(corrupt)), ReaderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := r.frames[2]
+	for i := 0; i < 16; i++ {
+		corrupt[f.offset+int64(i)] ^= 0x55
+	}
+	if _, err := r.ReadAt(make([]byte, 10), f.start); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("ReadAt in a corrupt frame returned %v, want a corrupt input error", err)
+	}
+	if _, err := r.ReadAt(make([]byte, 10), r.frames[3].start); err != nil {
+		t.Errorf("ReadAt in the next frame returned %v", err)
+	}
+}
+
+// forgeFrameSize returns a copy of the seekable stream b whose seek table
+// gives frame i the decompressed size size.
+func forgeFrameSize(b []byte, i int, size uint32) []byte {
+	b = append([]byte(nil), b...)
+	numFrames := int(binary.LittleEndian.Uint32(b[len(b)-1-seekFooterSize:]))
+	tableStart := len(b) - 1 - seekFooterSize - numFrames*seekEntrySize
+	binary.LittleEndian.PutUint32(b[tableStart+i*seekEntrySize+4:], size)
+	return b
+}
+
+func TestSeekableMemoryLimit(t *testing.T) {
+	input := utf8Text(100000)
+	var out bytes.Buffer
+	w := NewSeekableWriter(&out, WriterOptions{Quality: 5, LGWin: 18, ChunkSize: 20000})
+	w.Write(input)
+	w.Close()
+
+	for _, c := range []struct {
+		limit int64
+		err   error
+	}{
+		{2 << 20, nil},
+		{400000, nil},
+		{200000, ErrMemoryLimit},
+	} {
+		r, err := NewSeekableReader(bytes.NewReader(out.Bytes()), int64(out.Len()), ReaderOptions{MemoryLimit: c.limit})
+		if err != c.err {
+			t.Errorf("MemoryLimit %d: NewSeekableReader returned %v, want %v", c.limit, err, c.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		decoded, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(decoded, input) {
+			t.Errorf("MemoryLimit %d: Read returned %d bytes, %v", c.limit, len(decoded), err)
+		}
+	}
+
+	forged := forgeFrameSize(out.Bytes(), 1, 64<<20)
+	if _, err := NewSeekableReader(bytes.NewReader(forged), int64(len(forged)), ReaderOptions{MemoryLimit: 8 << 20}); err != ErrMemoryLimit {
+		t.Errorf("NewSeekableReader with a frame larger than MemoryLimit returned %v, want %v", err, ErrMemoryLimit)
+	}
+}
+
+func TestParallelReader(t *testing.T) {
+	input := utf8Text(500000)
+	var out bytes.Buffer
+	w := NewSeekableWriter(&out, WriterOptions{Quality: 5, LGWin: 18, ChunkSize: 40000})
+	w.Write(input)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	src := bytes.NewReader(out.Bytes())
+	for _, options := range []ReaderOptions{
+		{Concurrency: 1},
+		{Concurrency: 4},
+		{Concurrency: 4, MemoryLimit: 1 << 20},
+		{Concurrency: 4, MemoryLimit: 400000},
+		{Concurrency: 4, MemoryLimit: 16 << 20},
+	} {
+		r, err := NewParallelReader(src, int64(out.Len()), options)
+		if err != nil {
+			t.Fatalf("%+v: %v", options, err)
+		}
+		var decoded []byte
+		p := make([]byte, 1)
+		for {
+			n, err := r.Read(p)
+			decoded = append(decoded, p[:n]...)
+			if options.MemoryLimit > 0 && r.reserved > options.MemoryLimit {
+				t.Errorf("%+v: %d bytes reserved", options, r.reserved)
+			}
+			if err != nil {
+				if err != io.EOF || !bytes.Equal(decoded, input) {
+					t.Errorf("%+v: Read returned %d bytes, %v", options, len(decoded), err)
+				}
+				break
+			}
+		}
+
+		r, _ = NewParallelReader(src, int64(out.Len()), options)
+		var buf bytes.Buffer
+		n, err := r.WriteTo(&buf)
+		if err != nil || n != int64(len(input)) || !bytes.Equal(buf.Bytes(), input) {
+			t.Errorf("%+v: WriteTo returned %d, %v", options, n, err)
+		}
+	}
+
+	if _, err := NewParallelReader(src, int64(out.Len()), ReaderOptions{MemoryLimit: 200000}); err != ErrMemoryLimit {
+		t.Errorf("NewParallelReader with MemoryLimit 200000 returned %v, want %v", err, ErrMemoryLimit)
+	}
+	forged := forgeFrameSize(out.Bytes(), 3, 64<<20)
+	if _, err := NewParallelReader(bytes.NewReader(forged), int64(len(forged)), ReaderOptions{Concurrency: 4, MemoryLimit: 32 << 20}); err != ErrMemoryLimit {
+		t.Errorf("NewParallelReader with a frame larger than MemoryLimit returned %v, want %v", err, ErrMemoryLimit)
+	}
+
+	corrupt := append([]byte(nil), out.Bytes()...)
+	r, err := NewParallelReader(bytes.NewReader(corrupt), int64(len(corrupt)), ReaderOptions{Concurrency: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := r.sr.frames[5]
+	for i := 0; i < 16; i++ {
+		corrupt[f.offset+int64(i)] ^= 0x55
+	}
+	decoded, err := ioutil.ReadAll(r)
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("reading a corrupt frame returned %v, want a corrupt input error", err)
+	}
+	if !bytes.Equal(decoded, input[:f.start]) {
+		t.Errorf("got %d bytes before the corrupt frame, want %d", len(decoded), f.start)
+	}
+}
+
+// checkPrefixCode checks that the code lengths of c make a complete prefix
+// code.
+func checkPrefixCode(t *testing.T, name string, c *PrefixCode) {
+	if len(c.Symbols) == 0 || len(c.Symbols) != len(c.Lengths) {
+		t.Errorf("%s: %d symbols, %d lengths", name, len(c.Symbols), len(c.Lengths))
+		return
+	}
+	if len(c.Symbols) == 1 {
+		if c.Lengths[0] != 0 {
+			t.Errorf("%s: single symbol has length %d, want 0", name, c.Lengths[0])
+		}
+		return
+	}
+	var space int
+	for i, s := range c.Symbols {
+		if s >= c.AlphabetSize || (i > 0 && s <= c.Symbols[i-1]) {
+			t.Errorf("%s: symbols %v out of order or range", name, c.Symbols)
+			return
+		}
+		space += 1 << uint(15-c.Lengths[i])
+	}
+	if space != 1<<15 {
+		t.Errorf("%s: code lengths %v do not make a complete code", name, c.Lengths)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	input := utf8Text(300000)
+	for _, quality := range []int{1, 5, 11} {
+		compressed, _ := Encode(nil, input, WriterOptions{Quality: quality, LGWin: 18})
+		s, err := Inspect(bytes.NewReader(compressed), ReaderOptions{})
+		if err != nil {
+			t.Fatalf("quality %d: %v", quality, err)
+		}
+		if s.WindowBits != 18 || s.CompressedSize != int64(len(compressed)) || s.DecodedSize != int64(len(input)) {
+			t.Errorf("quality %d: window bits %d, sizes %d/%d, want 18, %d/%d", quality, s.WindowBits, s.CompressedSize, s.DecodedSize, len(compressed), len(input))
+		}
+		var offset int64
+		for i := range s.Metablocks {
+			mb := &s.Metablocks[i]
+			if mb.OutputOffset != offset {
+				t.Errorf("quality %d: metablock %d at output offset %d, want %d", quality, i, mb.OutputOffset, offset)
+			}
+			if mb.IsLast != (i == len(s.Metablocks)-1) {
+				t.Errorf("quality %d: metablock %d has IsLast = %v", quality, i, mb.IsLast)
+			}
+			if mb.IsMetadata || mb.IsUncompressed {
+				offset += int64(mb.Length)
+				continue
+			}
+			offset += int64(mb.Length)
+			if mb.Length == 0 {
+				continue
+			}
+			if len(mb.ContextModes) != mb.Literals.BlockTypes {
+				t.Errorf("quality %d: metablock %d has %d context modes for %d block types", quality, i, len(mb.ContextModes), mb.Literals.BlockTypes)
+			}
+			for j, c := range []*CategoryStructure{&mb.Literals, &mb.Commands, &mb.Distances} {
+				name := fmt.Sprintf("quality %d, metablock %d, category %d", quality, i, j)
+				if len(c.Codes) != c.Trees {
+					t.Errorf("%s: %d codes, want %d", name, len(c.Codes), c.Trees)
+				}
+				for k := range c.Codes {
+					checkPrefixCode(t, name, &c.Codes[k])
+				}
+				for _, k := range c.ContextMap {
+					if k >= c.Trees {
+						t.Errorf("%s: context map refers to tree %d of %d", name, k, c.Trees)
+					}
+				}
+				if c.BlockTypes > 1 {
+					checkPrefixCode(t, name+" block types", c.BlockTypeCode)
+					checkPrefixCode(t, name+" block counts", c.BlockCountCode)
+					for _, b := range c.Blocks {
+						if b.Type >= c.BlockTypes || b.Length <= 0 {
+							t.Errorf("%s: invalid block %+v", name, b)
+						}
+					}
+				} else if len(c.Blocks) != 0 {
+					t.Errorf("%s: %d blocks with a single block type", name, len(c.Blocks))
+				}
+			}
+			if len(mb.Literals.ContextMap) != 64*mb.Literals.BlockTypes || len(mb.Distances.ContextMap) != 4*mb.Distances.BlockTypes {
+				t.Errorf("quality %d: metablock %d has context maps of %d and %d entries", quality, i, len(mb.Literals.ContextMap), len(mb.Distances.ContextMap))
+			}
+		}
+		if offset != int64(len(input)) {
+			t.Errorf("quality %d: metablocks add up to %d bytes, want %d", quality, offset, len(input))
+		}
+	}
+
+	compressed, _ := Encode(nil, input, WriterOptions{Quality: 5})
+	s, err := Inspect(bytes.NewReader(compressed[:len(compressed)/2]), ReaderOptions{})
+	if err != io.ErrUnexpectedEOF || len(s.Metablocks) == 0 {
+		t.Errorf("Inspect on a truncated stream returned %d metablocks and %v", len(s.Metablocks), err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	input := utf8Text(300000)
+	var buf bytes.Buffer
+	w := NewWriter(&buf, WriterOptions{Quality: 5, LGWin: 20})
+	w.Write(input)
+	w.WriteMetadata([]byte("metadata"))
+	w.Close()
+	compressed := buf.Bytes()
+
+	info, err := Verify(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := Inspect(bytes.NewReader(compressed), ReaderOptions{})
+	want := Info{DecodedSize: int64(len(input)), CompressedSize: int64(len(compressed)), WindowBits: 20, Metablocks: len(s.Metablocks)}
+	if info != want {
+		t.Errorf("Verify returned %+v, want %+v", info, want)
+	}
+
+	if _, err := Verify(bytes.NewReader(compressed[:len(compressed)-10])); err != io.ErrUnexpectedEOF {
+		t.Errorf("Verify on a truncated stream returned %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	corrupt := append([]byte(nil), compressed...)
+	for i := 100; i < 110; i++ {
+		corrupt[i] ^= 0xff
+	}
+	info, err = Verify(bytes.NewReader(corrupt))
+	var de *DecodeError
+	if !errors.As(err, &de) || !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Verify on a corrupt stream returned %v, want a *DecodeError", err)
+	}
+	if de.Offset < 100 || info.DecodedSize != de.OutputOffset {
+		t.Errorf("Verify on a corrupt stream failed at byte %d after %d bytes of output, reporting %d", de.Offset, de.OutputOffset, info.DecodedSize)
+	}
+}
+
+func TestAcceptEncodingQuality(t *testing.T) {
+	for _, c := range []struct {
+		header string
+		q      float64
+	}{
+		{"", 0},
+		{"gzip", 0},
+		{"br", 1},
+		{"gzip, deflate, br", 1},
+		{"gzip;q=1.0, br;q=0.5", 0.5},
+		{"BR ; Q=0.8", 0.8},
+		{"br;q=0", 0},
+		{"*", 1},
+		{"*;q=0.3, gzip", 0.3},
+		{"br;q=0, *", 0},
+		{"br;q=abc", 0},
+		{"br;level=1", 1},
+	} {
+		if q := acceptEncodingQuality([]string{c.header}, "br"); q != c.q {
+			t.Errorf("Accept-Encoding %q gives br a q-value of %v, want %v", c.header, q, c.q)
+		}
+	}
+}
+
+// serveCompressed runs a request with the given Accept-Encoding through
+// CompressHandler wrapping h, and returns the response with its body
+// decoded.
+func serveCompressed(t *testing.T, h http.Handler, options CompressHandlerOptions, req *http.Request, acceptEncoding string) (*httptest.ResponseRecorder, []byte) {
+	t.Helper()
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	rec := httptest.NewRecorder()
+	CompressHandler(h, options).ServeHTTP(rec, req)
+	body := rec.Body.Bytes()
+	if rec.Header().Get("Content-Encoding") == "br" {
+		var err error
+		if body, err = ioutil.ReadAll(NewReader(bytes.NewReader(body))); err != nil {
+			t.Fatalf("decoding the response: %v", err)
+		}
+	}
+	return rec, body
+}
+
+func TestCompressHandler(t *testing.T) {
+	text := utf8Text(10000)
+	png := append([]byte("\x89PNG\r\n\x1a\n"), text...)
+	for _, c := range []struct {
+		name       string
+		method     string
+		accept     string
+		header     http.Header
+		status     int
+		body       []byte
+		compressed bool
+		vary       bool
+	}{
+		{name: "text", accept: "gzip, br", body: text, compressed: true, vary: true},
+		{name: "not accepted", accept: "gzip", body: text, vary: true},
+		{name: "no Accept-Encoding", body: text, vary: true},
+		{name: "refused", accept: "br;q=0, gzip", body: text, vary: true},
+		{name: "small", accept: "br", body: text[:100]},
+		{name: "small Content-Length", accept: "br", header: http.Header{"Content-Length": {"100"}}, body: text[:100]},
+		{name: "sniffed image", accept: "br", body: png},
+		{name: "image", accept: "br", header: http.Header{"Content-Type": {"image/jpeg"}}, body: text},
+		{name: "svg", accept: "br", header: http.Header{"Content-Type": {"image/SVG+xml; charset=utf-8"}}, body: text, compressed: true, vary: true},
+		{name: "encoded", accept: "br", header: http.Header{"Content-Encoding": {"gzip"}}, body: text},
+		{name: "no-transform", accept: "br", header: http.Header{"Cache-Control": {"public, no-transform"}}, body: text},
+		{name: "HEAD", method: "HEAD", accept: "br", header: http.Header{"Content-Length": {"10000"}}},
+		{name: "partial", accept: "br", status: http.StatusPartialContent, body: text},
+		{name: "not found", accept: "br", status: http.StatusNotFound, body: text, compressed: true, vary: true},
+		{name: "no content", accept: "br", status: http.StatusNoContent},
+		{name: "Vary", accept: "br", header: http.Header{"Vary": {"Origin, accept-encoding"}}, body: text, compressed: true, vary: true},
+		{name: "ETag", accept: "br", header: http.Header{"Etag": {`W/"abc"`}, "Content-Length": {"10000"}, "Accept-Ranges": {"bytes"}}, body: text, compressed: true, vary: true},
+	} {
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for k, v := range c.header {
+				w.Header()[k] = v
+			}
+			if c.status != 0 {
+				w.WriteHeader(c.status)
+			}
+			for b := c.body; len(b) > 0; b = b[len(b)/2+1:] {
+				w.Write(b[:len(b)/2+1])
+			}
+		})
+		method := c.method
+		if method == "" {
+			method = "GET"
+		}
+		rec, body := serveCompressed(t, h, CompressHandlerOptions{}, httptest.NewRequest(method, "/", nil), c.accept)
+		hdr := rec.Header()
+		if compressed := hdr.Get("Content-Encoding") == "br"; compressed != c.compressed {
+			t.Errorf("%s: compressed = %v, want %v", c.name, compressed, c.compressed)
+		}
+		if !bytes.Equal(body, c.body) {
+			t.Errorf("%s: wrong body", c.name)
+		}
+		if c.status != 0 && rec.Code != c.status {
+			t.Errorf("%s: status %d, want %d", c.name, rec.Code, c.status)
+		}
+		var vary int
+		for _, v := range hdr.Values("Vary") {
+			vary += strings.Count(strings.ToLower(v), "accept-encoding")
+		}
+		if vary != 0 != c.vary || vary > 1 {
+			t.Errorf("%s: Vary is %q", c.name, hdr.Values("Vary"))
+		}
+		if c.compressed && (hdr.Get("Content-Length") != "" || hdr.Get("Accept-Ranges") != "") {
+			t.Errorf("%s: compressed response has Content-Length %q and Accept-Ranges %q", c.name, hdr.Get("Content-Length"), hdr.Get("Accept-Ranges"))
+		}
+		if c.name == "ETag" && hdr.Get("Etag") != `W/"abc-br"` {
+			t.Errorf("%s: ETag is %q", c.name, hdr.Get("Etag"))
+		}
+		if c.name == "sniffed image" && hdr.Get("Content-Type") != "image/png" {
+			t.Errorf("%s: Content-Type is %q", c.name, hdr.Get("Content-Type"))
+		}
+	}
+}
+
+func TestCompressHandlerQuality(t *testing.T) {
+	text := utf8Text(100000)
+	var types []string
+	options := CompressHandlerOptions{
+		MinSize: 10,
+		Quality: func(mediaType string) int {
+			types = append(types, mediaType)
+			if mediaType == "application/json" {
+				return 11
+			}
+			return 1
+		},
+	}
+	sizes := make(map[string]int)
+	for _, contentType := range []string{"text/plain", "application/json; charset=utf-8"} {
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.Write(text)
+		})
+		// The second round reuses the pooled Writers.
+		for i := 0; i < 2; i++ {
+			rec, body := serveCompressed(t, h, options, httptest.NewRequest("GET", "/", nil), "br")
+			if !bytes.Equal(body, text) {
+				t.Fatalf("%s: wrong body", contentType)
+			}
+			sizes[contentType] = rec.Body.Len()
+		}
+	}
+	if len(types) != 4 || types[0] != "text/plain" || types[2] != "application/json" {
+		t.Errorf("Quality was called with %q", types)
+	}
+	if sizes["application/json; charset=utf-8"] >= sizes["text/plain"] {
+		t.Errorf("quality 11 gave %d bytes, quality 1 %d", sizes["application/json; charset=utf-8"], sizes["text/plain"])
+	}
+}
+
+func TestCompressHandlerFlush(t *testing.T) {
+	rec := httptest.NewRecorder()
+	var events [][]byte
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		var sent []byte
+		for i := 0; i < 3; i++ {
+			event := []byte(fmt.Sprintf("data: event %d\n\n", i))
+			events = append(events, event)
+			sent = append(sent, event...)
+			w.Write(event)
+			if err := http.NewResponseController(w).Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if !rec.Flushed {
+				t.Errorf("event %d: the response was not flushed", i)
+			}
+			got, _ := ioutil.ReadAll(NewReader(bytes.NewReader(rec.Body.Bytes())))
+			if !bytes.Equal(got, sent) {
+				t.Errorf("event %d: client received %q, want %q", i, got, sent)
+			}
+		}
+	})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "br")
+	CompressHandler(h, CompressHandlerOptions{}).ServeHTTP(rec, req)
+	if rec.Header().Get("Content-Encoding") != "br" {
+		t.Fatal("the event stream was not compressed")
+	}
+	got, err := ioutil.ReadAll(NewReader(bytes.NewReader(rec.Body.Bytes())))
+	if err != nil || !bytes.Equal(got, bytes.Join(events, nil)) {
+		t.Errorf("decoding the response gave %q, %v", got, err)
+	}
+}
+
+func TestCompressHandlerConditional(t *testing.T) {
+	text := utf8Text(10000)
+	modtime := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Etag", `"v1"`)
+		http.ServeContent(w, r, "a.txt", modtime, bytes.NewReader(text))
+	})
+	rec, body := serveCompressed(t, h, CompressHandlerOptions{}, httptest.NewRequest("GET", "/", nil), "br")
+	etag := rec.Header().Get("Etag")
+	if etag != `"v1-br"` || !bytes.Equal(body, text) {
+		t.Fatalf("first response has ETag %q", etag)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec, _ = serveCompressed(t, h, CompressHandlerOptions{}, req, "br")
+	if rec.Code != http.StatusNotModified || rec.Header().Get("Etag") != `"v1-br"` || rec.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("conditional request got status %d, ETag %q, Vary %q", rec.Code, rec.Header().Get("Etag"), rec.Header().Get("Vary"))
+	}
+
+	// A client without Brotli gets the original representation.
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("If-None-Match", `"v1"`)
+	rec, _ = serveCompressed(t, h, CompressHandlerOptions{}, req, "gzip")
+	if rec.Code != http.StatusNotModified || rec.Header().Get("Etag") != `"v1"` {
+		t.Errorf("conditional request without Brotli got status %d, ETag %q", rec.Code, rec.Header().Get("Etag"))
+	}
+}
+
+func TestTransport(t *testing.T) {
+	text := utf8Text(200000)
+	var acceptEncoding string
+	ts := httptest.NewServer(CompressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding = r.Header.Get("Accept-Encoding")
+		w.Header().Set("Content-Type", "text/plain")
+		if r.URL.Path == "/gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			zw.Write(text)
+			zw.Close()
+			return
+		}
+		w.Write(text)
+	}), CompressHandlerOptions{}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: NewTransport(nil, TransportOptions{})}
+	for i, path := range []string{"/", "/", "/gzip"} {
+		resp, err := client.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || !bytes.Equal(body, text) {
+			t.Errorf("request %d: wrong body, %v", i, err)
+		}
+		if acceptEncoding != "br, gzip" {
+			t.Errorf("request %d: sent Accept-Encoding %q", i, acceptEncoding)
+		}
+		if !resp.Uncompressed || resp.ContentLength != -1 || resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Length") != "" {
+			t.Errorf("request %d: Uncompressed %v, ContentLength %d, header %v", i, resp.Uncompressed, resp.ContentLength, resp.Header)
+		}
+	}
+
+	// A request that sets Accept-Encoding gets the response as it is.
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req.Header.Set("Accept-Encoding", "br")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Uncompressed || resp.Header.Get("Content-Encoding") != "br" || bytes.Equal(body, text) {
+		t.Errorf("request with Accept-Encoding: Uncompressed %v, Content-Encoding %q", resp.Uncompressed, resp.Header.Get("Content-Encoding"))
+	}
+	if got, err := ioutil.ReadAll(NewReader(bytes.NewReader(body))); err != nil || !bytes.Equal(got, text) {
+		t.Errorf("request with Accept-Encoding: response does not decode")
+	}
+}
+
+func TestTransportLimit(t *testing.T) {
+	zeros := make([]byte, 10<<20)
+	compressed, _ := Encode(nil, zeros, WriterOptions{Quality: 5})
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	zw.Write(zeros)
+	zw.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(gzipped.Bytes())
+			return
+		}
+		w.Header().Set("Content-Encoding", "br")
+		w.Write(compressed)
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: NewTransport(nil, TransportOptions{ReaderOptions: ReaderOptions{MaxDecodedSize: 100000}})}
+	for _, path := range []string{"/", "/gzip"} {
+		resp, err := client.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !errors.Is(err, ErrOutputLimit) || len(body) > 100000 {
+			t.Errorf("%s: read %d bytes, then %v", path, len(body), err)
+		}
+	}
+}
+
+func TestTransportRequestBody(t *testing.T) {
+	text := utf8Text(100000)
+	var received []byte
+	var encoding string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		received, _ = ioutil.ReadAll(NewReader(r.Body))
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: NewTransport(nil, TransportOptions{RequestOptions: &WriterOptions{Quality: 5}})}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Post(ts.URL, "text/plain", bytes.NewReader(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if encoding != "br" || !bytes.Equal(received, text) {
+			t.Errorf("request %d: server received %d bytes with Content-Encoding %q", i, len(received), encoding)
+		}
+	}
+}
+
+func TestDecompressRequestHandler(t *testing.T) {
+	text := utf8Text(200000)
+	compressed, _ := Encode(nil, text, WriterOptions{Quality: 5})
+	bomb, _ := Encode(nil, make([]byte, 400000), WriterOptions{Quality: 5})
+	corrupt := append([]byte(nil), compressed...)
+	for i := 100; i < 120; i++ {
+		corrupt[i] ^= 0x55
+	}
+
+	var received []byte
+	var stats ReaderStats
+	var statsOK bool
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "" || r.ContentLength != -1 && r.Header.Get("X-Plain") == "" {
+			t.Errorf("handler got Content-Encoding %q, ContentLength %d", r.Header.Get("Content-Encoding"), r.ContentLength)
+		}
+		var err error
+		received, err = ioutil.ReadAll(r.Body)
+		stats, statsOK = RequestBodyStats(r)
+		if err != nil {
+			// A careless handler: the middleware sets the status.
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	options := DecompressRequestOptions{ReaderOptions: ReaderOptions{MaxDecodedSize: 500000}, MaxRatio: 100}
+	for _, c := range []struct {
+		name     string
+		encoding string
+		body     []byte
+		status   int
+	}{
+		{"br", "br", compressed, http.StatusOK},
+		{"BR", " BR ", compressed, http.StatusOK},
+		{"plain", "", text, http.StatusOK},
+		{"too large", "br", func() []byte { b, _ := Encode(nil, utf8Text(600000), WriterOptions{Quality: 5}); return b }(), http.StatusRequestEntityTooLarge},
+		{"bomb", "br", bomb, http.StatusRequestEntityTooLarge},
+		{"corrupt", "br", corrupt, http.StatusBadRequest},
+		{"truncated", "br", compressed[:len(compressed)/2], http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest("POST", "/", bytes.NewReader(c.body))
+		if c.encoding != "" {
+			req.Header.Set("Content-Encoding", c.encoding)
+		} else {
+			req.Header.Set("X-Plain", "1")
+		}
+		rec := httptest.NewRecorder()
+		DecompressRequestHandler(h, options).ServeHTTP(rec, req)
+		if rec.Code != c.status {
+			t.Errorf("%s: status %d, want %d: %s", c.name, rec.Code, c.status, rec.Body.Bytes())
+		}
+		if c.name == "bomb" && !strings.Contains(rec.Body.String(), "ratio") {
+			t.Errorf("%s: rejected with %q", c.name, rec.Body.Bytes())
+		}
+		if c.status != http.StatusOK {
+			continue
+		}
+		if !bytes.Equal(received, text) || rec.Body.String() != "ok" {
+			t.Errorf("%s: handler received %d bytes, responded %q", c.name, len(received), rec.Body.Bytes())
+		}
+		if c.encoding == "" {
+			if statsOK {
+				t.Errorf("%s: RequestBodyStats reported a plain body", c.name)
+			}
+		} else if !statsOK || stats.BytesIn != int64(len(compressed)) || stats.BytesOut != int64(len(text)) {
+			t.Errorf("%s: RequestBodyStats returned %+v, %v", c.name, stats, statsOK)
+		}
+	}
+}
+
+func TestPrecompress(t *testing.T) {
+	dir := t.TempDir()
+	text := utf8Text(20000)
+	random := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(random)
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	for name, data := range map[string][]byte{
+		"a.txt":      text,
+		"small.txt":  text[:100],
+		"random.bin": random,
+		"sub/b.js":   text[:5000],
+		// Left over from an earlier run.
+		"random.bin.br": []byte("stale"),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dir, "random.bin.br"), old, old)
+
+	written, err := Precompress(dir, os.DirFS(dir), PrecompressOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != 2 || written[0] != "a.txt.br" || written[1] != "sub/b.js.br" {
+		t.Errorf("Precompress wrote %q", written)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "random.bin.br")); !os.IsNotExist(err) {
+		t.Errorf("stale compressed file was not removed: %v", err)
+	}
+	compressed, _ := ioutil.ReadFile(filepath.Join(dir, "a.txt.br"))
+	s, err := Inspect(bytes.NewReader(compressed), ReaderOptions{})
+	if err != nil || s.DecodedSize != int64(len(text)) || s.WindowBits != 15 {
+		t.Errorf("a.txt.br decodes to %d bytes with window bits %d, %v", s.DecodedSize, s.WindowBits, err)
+	}
+	if written, err := Precompress(dir, os.DirFS(dir), PrecompressOptions{}); err != nil || len(written) != 0 {
+		t.Errorf("second run wrote %q, %v", written, err)
+	}
+
+	// Files without modification times, as in an embed.FS.
+	out := t.TempDir()
+	written, err = Precompress(out, fstest.MapFS{"x/y.html": {Data: text}}, PrecompressOptions{MinSize: 1 << 20})
+	if err != nil || len(written) != 0 {
+		t.Errorf("Precompress with MinSize wrote %q, %v", written, err)
+	}
+	written, err = Precompress(out, fstest.MapFS{"x/y.html": {Data: text}}, PrecompressOptions{})
+	if err != nil || len(written) != 1 {
+		t.Errorf("Precompress from a MapFS wrote %q, %v", written, err)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(out, "x", "y.html.br")); !bytes.Equal(got, compressed) {
+		t.Errorf("the compressed copy from the MapFS differs")
+	}
+}
+
+func TestPrecompressedFileServer(t *testing.T) {
+	dir := t.TempDir()
+	text := utf8Text(20000)
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), text, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "data"), text, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "small.txt"), text[:100], 0644)
+	if _, err := Precompress(dir, os.DirFS(dir), PrecompressOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	compressed, _ := ioutil.ReadFile(filepath.Join(dir, "a.txt.br"))
+	h := PrecompressedFileServer(http.Dir(dir))
+
+	get := func(path, acceptEncoding string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/a.txt", "gzip, br")
+	hdr := rec.Header()
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), compressed) {
+		t.Fatalf("compressed response has status %d and %d bytes", rec.Code, rec.Body.Len())
+	}
+	if hdr.Get("Content-Encoding") != "br" || hdr.Get("Content-Type") != "text/plain; charset=utf-8" || hdr.Get("Vary") != "Accept-Encoding" || !strings.HasSuffix(hdr.Get("Etag"), `-br"`) {
+		t.Errorf("compressed response has header %v", hdr)
+	}
+	brETag := hdr.Get("Etag")
+
+	rec = get("/a.txt", "gzip")
+	hdr = rec.Header()
+	if !bytes.Equal(rec.Body.Bytes(), text) || hdr.Get("Content-Encoding") != "" || hdr.Get("Vary") != "Accept-Encoding" || hdr.Get("Etag") == "" || hdr.Get("Etag") == brETag {
+		t.Errorf("uncompressed response has header %v", hdr)
+	}
+
+	// Without an extension, the type is sniffed from the original.
+	if rec = get("/data", "br"); rec.Header().Get("Content-Type") != "text/plain; charset=utf-8" || rec.Header().Get("Content-Encoding") != "br" {
+		t.Errorf("compressed response without extension has header %v", rec.Header())
+	}
+	if rec = get("/small.txt", "br"); !bytes.Equal(rec.Body.Bytes(), text[:100]) || rec.Header().Get("Vary") != "" {
+		t.Errorf("response without compressed copy has header %v", rec.Header())
+	}
+	if rec = get("/a.txt", "br", "If-None-Match", brETag); rec.Code != http.StatusNotModified {
+		t.Errorf("conditional request got status %d", rec.Code)
+	}
+	if rec = get("/a.txt", "br", "Range", "bytes=10-19"); rec.Code != http.StatusPartialContent || !bytes.Equal(rec.Body.Bytes(), compressed[10:20]) {
+		t.Errorf("range request got status %d", rec.Code)
+	}
+	if rec = get("/missing.txt", "br"); rec.Code != http.StatusNotFound {
+		t.Errorf("missing file got status %d", rec.Code)
+	}
+	if rec = get("/", "br"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "a.txt") {
+		t.Errorf("directory listing got status %d", rec.Code)
+	}
+
+	// A file that changes gets a new ETag, which replaces the old one.
+	etag := get("/small.txt", "").Header().Get("Etag")
+	for i := 0; i < 3; i++ {
+		name := filepath.Join(dir, "small.txt")
+		ioutil.WriteFile(name, text[i+1:i+101], 0644)
+		mtime := time.Now().Add(time.Duration(i+1) * time.Hour)
+		os.Chtimes(name, mtime, mtime)
+		newETag := get("/small.txt", "").Header().Get("Etag")
+		if newETag == etag {
+			t.Errorf("ETag %s unchanged after the file changed", etag)
+		}
+		etag = newETag
+	}
+	// One for each of a.txt, a.txt.br, data.br and small.txt.
+	entries := 0
+	h.(*precompressedFileServer).etags.Range(func(key, value interface{}) bool {
+		entries++
+		return true
+	})
+	if want := 4; entries != want {
+		t.Errorf("%d ETags cached, want %d", entries, want)
+	}
+}
+
+// encodeStream returns content encoded with Brotli by a Writer.
+func encodeStream(content []byte, options WriterOptions) ([]byte, error) {
 	var buf bytes.Buffer
 	writer := NewWriter(&buf, options)
 	_, err := writer.Write(content)
@@ -389,8 +2615,8 @@ func Encode(content []byte, options WriterOptions) ([]byte, error) {
 	return buf.Bytes(), err
 }
 
-// Decode decodes Brotli encoded data.
-func Decode(encodedData []byte) ([]byte, error) {
+// decodeStream decodes Brotli encoded data with a Reader.
+func decodeStream(encodedData []byte) ([]byte, error) {
 	r := NewReader(bytes.NewReader(encodedData))
 	return ioutil.ReadAll(r)
 }
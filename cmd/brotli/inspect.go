@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/andybalholm/brotli"
+)
+
+// inspect runs "brotli inspect".
+func (e *env) inspect(args []string) int {
+	flags := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	flags.SetOutput(e.stderr)
+	asJSON := flags.Bool("json", false, "print the structure as JSON")
+	largeWindow := flags.Bool("large_window", false, "allow large window streams")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 1 {
+		fmt.Fprintf(e.stderr, "usage: brotli inspect [-json] [-large_window] [file]\n")
+		return 2
+	}
+
+	var src io.Reader = e.stdin
+	if name := flags.Arg(0); name != "" && name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintf(e.stderr, "brotli: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		src = f
+	}
+	s, err := brotli.Inspect(src, brotli.ReaderOptions{LargeWindow: *largeWindow})
+	if s != nil {
+		if *asJSON {
+			enc := json.NewEncoder(e.stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(s)
+		} else {
+			printStream(e.stdout, s)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(e.stderr, "brotli: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func printStream(w io.Writer, s *brotli.StreamStructure) {
+	fmt.Fprintf(w, "window bits %d", s.WindowBits)
+	if s.LargeWindow {
+		fmt.Fprintf(w, " (large window)")
+	}
+	fmt.Fprintf(w, ", %d bytes compressed, %d decoded, %d metablocks\n", s.CompressedSize, s.DecodedSize, len(s.Metablocks))
+	for i := range s.Metablocks {
+		mb := &s.Metablocks[i]
+		fmt.Fprintf(w, "\nmetablock %d at bit %d, output offset %d: MLEN %d", i, mb.BitOffset, mb.OutputOffset, mb.Length)
+		switch {
+		case mb.IsMetadata:
+			fmt.Fprintf(w, ", metadata")
+		case mb.IsUncompressed:
+			fmt.Fprintf(w, ", uncompressed")
+		}
+		if mb.IsLast {
+			fmt.Fprintf(w, ", last")
+		}
+		fmt.Fprintln(w)
+		if mb.IsMetadata || mb.IsUncompressed || mb.Length == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "  NPOSTFIX %d, NDIRECT %d\n", mb.DistancePostfixBits, mb.DirectDistanceCodes)
+		fmt.Fprintf(w, "  context modes %v\n", mb.ContextModes)
+		printCategory(w, "literals", &mb.Literals)
+		printCategory(w, "commands", &mb.Commands)
+		printCategory(w, "distances", &mb.Distances)
+	}
+}
+
+func printCategory(w io.Writer, name string, c *brotli.CategoryStructure) {
+	fmt.Fprintf(w, "  %s: NBLTYPES %d, NTREES %d\n", name, c.BlockTypes, c.Trees)
+	if c.BlockTypeCode != nil {
+		printCode(w, "block type code", c.BlockTypeCode)
+	}
+	if c.BlockCountCode != nil {
+		printCode(w, "block count code", c.BlockCountCode)
+	}
+	if len(c.Blocks) > 0 {
+		fmt.Fprintf(w, "    blocks (type:length)")
+		for _, b := range c.Blocks {
+			fmt.Fprintf(w, " %d:%d", b.Type, b.Length)
+		}
+		fmt.Fprintln(w)
+	}
+	if c.ContextMap != nil {
+		fmt.Fprintf(w, "    context map %v\n", c.ContextMap)
+	}
+	for i := range c.Codes {
+		printCode(w, fmt.Sprintf("tree %d", i), &c.Codes[i])
+	}
+}
+
+func printCode(w io.Writer, name string, c *brotli.PrefixCode) {
+	kind := "complex"
+	if c.Simple {
+		kind = "simple"
+	}
+	fmt.Fprintf(w, "    %s: %s, alphabet %d, symbol:length", name, kind, c.AlphabetSize)
+	for i, s := range c.Symbols {
+		fmt.Fprintf(w, " %d:%d", s, c.Lengths[i])
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,434 @@
+// Command brotli compresses and decompresses files in the Brotli format. It
+// takes the same options as the reference brotli tool, and its output is the
+// same as that of the package's Writer with the corresponding options. Run
+// "brotli -h" for the list.
+//
+// Two subcommands go beyond the reference tool:
+//
+//	brotli inspect [-json] [-large_window] [file]
+//	brotli test [OPTION]... [FILE]...
+//
+// inspect prints how a stream is encoded: the header of each metablock and
+// the prefix codes, block types and context maps it declares, as text or as
+// JSON. test is the same as "brotli -t": it checks that each file holds a
+// valid stream, like "gzip -t". To work on a file named inspect or test, put
+// "--" before it.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+const usageText = `Usage: brotli [OPTION]... [FILE]...
+Options:
+  -#                          compression level (0-9)
+  -c, --stdout                write on standard output
+  -d, --decompress            decompress
+  -f, --force                 force output file overwrite
+  -h, --help                  display this help and exit
+  -j, --rm                    remove source file(s)
+  -k, --keep                  keep source file(s) (default)
+  -n, --no-copy-stat          do not copy source file(s) attributes
+  -o FILE, --output=FILE      output file (only if 1 input file)
+  -q NUM, --quality=NUM       compression level (0-11) (default: 11)
+  -t, --test                  test compressed file integrity
+  -v, --verbose               verbose mode
+  -w NUM, --lgwin=NUM         set LZ77 window size (0, 10-24) (default: 0)
+                              window size = 2**NUM - 16
+                              0 lets compressor choose the optimal value
+  --large_window=NUM          use incompatible large-window brotli
+                              bitstream with window size (0, 10-30)
+                              WARNING: this format is not compatible
+                              with brotli RFC 7932 and may not be
+                              decodable with regular brotli decoders
+  -S SUF, --suffix=SUF        output file suffix (default: '.br')
+  -Z, --best                  use best compression level (11) (default)
+Simple options could be coalesced, i.e. '-9kf' is equivalent to '-9 -k -f'.
+With no FILE, or when FILE is -, read standard input.
+All arguments after '--' are treated as files.
+`
+
+// env holds the standard streams of the command, which tests replace.
+type env struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func main() {
+	e := &env{stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr}
+	os.Exit(e.main(os.Args[1:]))
+}
+
+// main runs the command with the arguments args and returns its exit status.
+func (e *env) main(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "inspect":
+			return e.inspect(args[1:])
+		case "test":
+			return e.run(append([]string{"-t"}, args[1:]...))
+		}
+	}
+	return e.run(args)
+}
+
+// options holds the parsed command line.
+type options struct {
+	decompress  bool
+	test        bool
+	toStdout    bool
+	force       bool
+	removeSrc   bool
+	noCopyStat  bool
+	verbose     bool
+	help        bool
+	quality     int
+	lgwin       int
+	largeWindow bool
+	output      string
+	suffix      string
+	files       []string
+}
+
+// parseArgs parses the command line the way the reference tool does.
+func parseArgs(args []string) (*options, error) {
+	o := &options{quality: 11, suffix: ".br"}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			o.files = append(o.files, args[i+1:]...)
+			i = len(args)
+		case strings.HasPrefix(arg, "--"):
+			name, value := arg[2:], ""
+			hasValue := false
+			if j := strings.IndexByte(name, '='); j >= 0 {
+				name, value, hasValue = name[:j], name[j+1:], true
+			}
+			if err := o.setLong(name, value, hasValue); err != nil {
+				return nil, err
+			}
+		case len(arg) > 1 && arg[0] == '-':
+			for j := 1; j < len(arg); j++ {
+				c := arg[j]
+				if c >= '0' && c <= '9' {
+					o.quality = int(c - '0')
+					continue
+				}
+				if !strings.ContainsRune("oqwS", rune(c)) {
+					if err := o.setFlag(c); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				// The value is the rest of the argument, or the next one.
+				value := arg[j+1:]
+				if value == "" {
+					if i+1 == len(args) {
+						return nil, fmt.Errorf("expected parameter for argument -%c", c)
+					}
+					i++
+					value = args[i]
+				}
+				if err := o.setValue(string(c), value); err != nil {
+					return nil, err
+				}
+				break
+			}
+		default:
+			o.files = append(o.files, arg)
+		}
+	}
+
+	if o.output != "" && (o.toStdout || o.test) {
+		return nil, errors.New("-o cannot be combined with -c or -t")
+	}
+	if o.output != "" && len(o.files) > 1 {
+		return nil, errors.New("-o needs a single input file")
+	}
+	return o, nil
+}
+
+// setFlag sets the short option c, which takes no value.
+func (o *options) setFlag(c byte) error {
+	switch c {
+	case 'c':
+		o.toStdout = true
+	case 'd':
+		o.decompress = true
+	case 'f':
+		o.force = true
+	case 'h':
+		o.help = true
+	case 'j':
+		o.removeSrc = true
+	case 'k':
+		o.removeSrc = false
+	case 'n':
+		o.noCopyStat = true
+	case 't':
+		o.test = true
+	case 'v':
+		o.verbose = true
+	case 'Z':
+		o.quality = 11
+	default:
+		return fmt.Errorf("invalid option -%c", c)
+	}
+	return nil
+}
+
+// longFlags maps the long options that take no value to their short forms.
+var longFlags = map[string]byte{
+	"best":         'Z',
+	"decompress":   'd',
+	"force":        'f',
+	"help":         'h',
+	"keep":         'k',
+	"no-copy-stat": 'n',
+	"rm":           'j',
+	"stdout":       'c',
+	"test":         't',
+	"verbose":      'v',
+}
+
+// setLong sets the long option name.
+func (o *options) setLong(name, value string, hasValue bool) error {
+	if c, ok := longFlags[name]; ok {
+		if hasValue {
+			return fmt.Errorf("option --%s takes no parameter", name)
+		}
+		return o.setFlag(c)
+	}
+	switch name {
+	case "output", "quality", "lgwin", "suffix", "large_window":
+		if !hasValue {
+			return fmt.Errorf("expected parameter for argument --%s", name)
+		}
+		return o.setValue(name, value)
+	}
+	return fmt.Errorf("invalid option --%s", name)
+}
+
+// setValue sets the option name, in its short or long form, to value.
+func (o *options) setValue(name, value string) error {
+	switch name {
+	case "o", "output":
+		o.output = value
+		return nil
+	case "S", "suffix":
+		if value == "" || strings.ContainsAny(value, "/\\") {
+			return fmt.Errorf("invalid suffix %q", value)
+		}
+		o.suffix = value
+		return nil
+	}
+
+	n, err := strconv.Atoi(value)
+	switch name {
+	case "q", "quality":
+		if err != nil || n < 0 || n > 11 {
+			return fmt.Errorf("invalid quality %q", value)
+		}
+		o.quality = n
+	case "w", "lgwin":
+		if err != nil || n != 0 && (n < 10 || n > 24) {
+			return fmt.Errorf("invalid window size %q", value)
+		}
+		o.lgwin = n
+	case "large_window":
+		if err != nil || n != 0 && (n < 10 || n > 30) {
+			return fmt.Errorf("invalid window size %q", value)
+		}
+		o.lgwin = n
+		o.largeWindow = true
+	}
+	return nil
+}
+
+// run compresses, decompresses or tests the files on the command line.
+func (e *env) run(args []string) int {
+	o, err := parseArgs(args)
+	if err != nil {
+		fmt.Fprintf(e.stderr, "brotli: %v\nUse -h for help.\n", err)
+		return 1
+	}
+	if o.help {
+		fmt.Fprint(e.stdout, usageText)
+		return 0
+	}
+	files := o.files
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	status := 0
+	for _, name := range files {
+		if err := e.process(o, name); err != nil {
+			fmt.Fprintf(e.stderr, "brotli: %v\n", err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// process handles the input file name, or standard input for "-".
+func (e *env) process(o *options, name string) error {
+	var src io.Reader = e.stdin
+	var info os.FileInfo
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if info, err = f.Stat(); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("%s: not a regular file", name)
+		}
+		src = f
+	}
+	if o.test {
+		return e.test(o, name, src)
+	}
+
+	outName := o.output
+	if outName == "" && name != "-" && !o.toStdout {
+		if !o.decompress {
+			outName = name + o.suffix
+		} else if len(name) > len(o.suffix) && strings.HasSuffix(name, o.suffix) {
+			outName = name[:len(name)-len(o.suffix)]
+		} else {
+			return fmt.Errorf("%s: does not end with suffix %s", name, o.suffix)
+		}
+	}
+	dst := &countingWriter{w: e.stdout}
+	var out *os.File
+	if outName != "" {
+		flag := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+		if o.force {
+			flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		}
+		var err error
+		if out, err = os.OpenFile(outName, flag, 0644); err != nil {
+			if os.IsExist(err) {
+				return fmt.Errorf("%s already exists; use -f to overwrite it", outName)
+			}
+			return err
+		}
+		dst.w = out
+	}
+
+	start := time.Now()
+	var read int64
+	var err error
+	if o.decompress {
+		r := brotli.NewReaderOptions(src, brotli.ReaderOptions{LargeWindow: true})
+		_, err = r.WriteTo(dst)
+		read = r.Stats().BytesIn
+	} else {
+		var sizeHint int64
+		if info != nil {
+			sizeHint = info.Size()
+			if sizeHint > 1<<30 {
+				sizeHint = 1 << 30
+			}
+		}
+		w := brotli.NewWriter(dst, brotli.WriterOptions{
+			Quality:     o.quality,
+			LGWin:       o.lgwin,
+			LargeWindow: o.largeWindow,
+			SizeHint:    int(sizeHint),
+		})
+		read, err = w.ReadFrom(src)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if out != nil {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(outName)
+		} else if info != nil && !o.noCopyStat {
+			err = copyStat(outName, info)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+
+	if o.verbose {
+		verb := "Compressed"
+		if o.decompress {
+			verb = "Decompressed"
+		}
+		fmt.Fprintf(e.stderr, "%s [%s]: %s -> %s in %.2f sec\n", verb, name, formatBytes(read), formatBytes(dst.n), time.Since(start).Seconds())
+	}
+	if o.removeSrc && info != nil {
+		return os.Remove(name)
+	}
+	return nil
+}
+
+// test checks the stream read from src, from the file name.
+func (e *env) test(o *options, name string, src io.Reader) error {
+	info, err := brotli.VerifyOptions(src, brotli.ReaderOptions{LargeWindow: true})
+	if err != nil {
+		var de *brotli.DecodeError
+		if errors.As(err, &de) {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		return fmt.Errorf("%s: %v after %d bytes", name, err, info.CompressedSize)
+	}
+	if o.verbose {
+		fmt.Fprintf(e.stderr, "%s: OK, %d bytes compressed, %d decoded, window bits %d, %d metablocks\n", name, info.CompressedSize, info.DecodedSize, info.WindowBits, info.Metablocks)
+	}
+	return nil
+}
+
+// copyStat gives the file name the permissions and modification time of
+// the source file.
+func copyStat(name string, info os.FileInfo) error {
+	if err := os.Chmod(name, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(name, info.ModTime(), info.ModTime())
+}
+
+// formatBytes formats n the way the reference tool does in verbose mode.
+func formatBytes(n int64) string {
+	switch {
+	case n < 1<<10:
+		return fmt.Sprintf("%d B", n)
+	case n < 1<<20:
+		return fmt.Sprintf("%.3f KiB", float64(n)/(1<<10))
+	case n < 1<<30:
+		return fmt.Sprintf("%.3f MiB", float64(n)/(1<<20))
+	}
+	return fmt.Sprintf("%.3f GiB", float64(n)/(1<<30))
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
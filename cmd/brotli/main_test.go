@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+// testData returns n bytes of compressible text.
+func testData(n int) []byte {
+	var b bytes.Buffer
+	for i := 0; b.Len() < n; i++ {
+		b.WriteString("line ")
+		b.WriteString(strings.Repeat("ab", i%17))
+		b.WriteString(" of the test file\n")
+	}
+	return b.Bytes()[:n]
+}
+
+// runCommand runs the command with args and stdin, and returns its exit
+// status and output.
+func runCommand(t *testing.T, stdin []byte, args ...string) (status int, stdout, stderr []byte) {
+	t.Helper()
+	var out, errOut bytes.Buffer
+	e := &env{stdin: bytes.NewReader(stdin), stdout: &out, stderr: &errOut}
+	status = e.main(args)
+	return status, out.Bytes(), errOut.Bytes()
+}
+
+// encode compresses data with the library, the way the command does.
+func encode(t *testing.T, data []byte, options brotli.WriterOptions) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	w := brotli.NewWriter(&b, options)
+	w.ReadFrom(bytes.NewReader(data))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func writeFile(t *testing.T, name string, data []byte, mode os.FileMode, mtime time.Time) {
+	t.Helper()
+	if err := ioutil.WriteFile(name, data, mode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(name, mode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func exists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+func TestCompressDecompress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "brotli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "data.txt")
+	data := testData(200000)
+	mtime := time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+	writeFile(t, name, data, 0640, mtime)
+
+	if status, _, stderr := runCommand(t, nil, "-q", "5", name); status != 0 {
+		t.Fatalf("compression failed: %s", stderr)
+	}
+	compressed := readFile(t, name+".br")
+	want := encode(t, data, brotli.WriterOptions{Quality: 5, SizeHint: len(data)})
+	if !bytes.Equal(compressed, want) {
+		t.Errorf("compressed file differs from the library's output")
+	}
+	if !exists(name) {
+		t.Errorf("source file was removed without -j")
+	}
+	info, err := os.Stat(name + ".br")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 || !info.ModTime().Equal(mtime) {
+		t.Errorf("compressed file has mode %v and mtime %v, want %v and %v", info.Mode().Perm(), info.ModTime(), os.FileMode(0640), mtime)
+	}
+
+	if status, _, _ := runCommand(t, nil, "-q", "5", name); status == 0 {
+		t.Errorf("compression overwrote an existing file without -f")
+	}
+	if status, _, stderr := runCommand(t, nil, "-9f", name); status != 0 {
+		t.Errorf("compression with -f failed: %s", stderr)
+	} else if got := readFile(t, name+".br"); !bytes.Equal(got, encode(t, data, brotli.WriterOptions{Quality: 9, SizeHint: len(data)})) {
+		t.Errorf("compressed file with -9 differs from the library's output")
+	}
+
+	os.Remove(name)
+	if status, _, stderr := runCommand(t, nil, "-dj", name+".br"); status != 0 {
+		t.Fatalf("decompression failed: %s", stderr)
+	}
+	if got := readFile(t, name); !bytes.Equal(got, data) {
+		t.Errorf("decompressed file differs from the original")
+	}
+	if exists(name + ".br") {
+		t.Errorf("source file was kept with -j")
+	}
+	if info, err := os.Stat(name); err != nil || !info.ModTime().Equal(mtime) {
+		t.Errorf("decompressed file does not have the mtime of the source")
+	}
+
+	if status, _, _ := runCommand(t, nil, "-d", name); status == 0 {
+		t.Errorf("decompression of a file without the suffix succeeded")
+	}
+}
+
+func TestOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "brotli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := testData(50000)
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	writeFile(t, a, data, 0644, mtime)
+	writeFile(t, b, data[:1000], 0644, mtime)
+
+	// Standard input and output.
+	status, stdout, _ := runCommand(t, data, "--quality=3")
+	if status != 0 || !bytes.Equal(stdout, encode(t, data, brotli.WriterOptions{Quality: 3})) {
+		t.Errorf("compression from standard input failed")
+	}
+	if status, got, _ := runCommand(t, stdout, "-d", "-"); status != 0 || !bytes.Equal(got, data) {
+		t.Errorf("decompression from standard input failed")
+	}
+
+	// -c with several files concatenates their streams.
+	status, stdout, _ = runCommand(t, nil, "-c", "-q", "1", "-w", "16", a, b)
+	want := append(encode(t, data, brotli.WriterOptions{Quality: 1, LGWin: 16, SizeHint: len(data)}), encode(t, data[:1000], brotli.WriterOptions{Quality: 1, LGWin: 16, SizeHint: 1000})...)
+	if status != 0 || !bytes.Equal(stdout, want) {
+		t.Errorf("compression of two files to standard output failed")
+	}
+	if exists(a+".br") || exists(b+".br") {
+		t.Errorf("compression with -c created files")
+	}
+
+	// -o, -S and --large_window.
+	out := filepath.Join(dir, "out")
+	if status, _, stderr := runCommand(t, nil, "-o", out, "--large_window=26", "-q5", a); status != 0 {
+		t.Fatalf("compression with -o failed: %s", stderr)
+	}
+	if got := readFile(t, out); !bytes.Equal(got, encode(t, data, brotli.WriterOptions{Quality: 5, LGWin: 26, LargeWindow: true, SizeHint: len(data)})) {
+		t.Errorf("compression with --large_window differs from the library's output")
+	}
+	if status, _, stderr := runCommand(t, nil, "-S", ".bro", "--no-copy-stat", a, b); status != 0 {
+		t.Fatalf("compression with -S failed: %s", stderr)
+	}
+	if info, err := os.Stat(b + ".bro"); err != nil || info.ModTime().Equal(mtime) {
+		t.Errorf("compression with -n copied the mtime")
+	}
+	os.Remove(a)
+	if status, _, stderr := runCommand(t, nil, "--decompress", "--suffix=.bro", a+".bro"); status != 0 {
+		t.Fatalf("decompression with --suffix failed: %s", stderr)
+	}
+	if got := readFile(t, a); !bytes.Equal(got, data) {
+		t.Errorf("decompressed file differs from the original")
+	}
+
+	// -t and the test subcommand.
+	if status, _, stderr := runCommand(t, nil, "-t", out, b+".bro"); status != 0 {
+		t.Errorf("test of valid files failed: %s", stderr)
+	}
+	corrupt := readFile(t, b+".bro")
+	corrupt = corrupt[:len(corrupt)-5]
+	writeFile(t, b+".bro", corrupt, 0644, mtime)
+	if status, _, stderr := runCommand(t, nil, "test", "-v", out, b+".bro"); status != 1 || !strings.Contains(string(stderr), b+".bro") {
+		t.Errorf("test of a truncated file returned %d: %s", status, stderr)
+	}
+
+	for _, args := range [][]string{
+		{"-q", "12", a},
+		{"-w", "9", a},
+		{"--large_window=31", a},
+		{"-x", a},
+		{"--unknown", a},
+		{"-o", out, a, b},
+		{"-c", "-o", out, a},
+		{"-q"},
+	} {
+		if status, _, _ := runCommand(t, nil, args...); status == 0 {
+			t.Errorf("%q succeeded", args)
+		}
+	}
+	if status, stdout, _ := runCommand(t, nil, "-h"); status != 0 || !bytes.Contains(stdout, []byte("Usage")) {
+		t.Errorf("-h did not print the usage")
+	}
+}
+
+func TestInspectCommand(t *testing.T) {
+	data := testData(50000)
+	compressed := encode(t, data, brotli.WriterOptions{Quality: 9})
+	status, stdout, _ := runCommand(t, compressed, "inspect")
+	if status != 0 || !bytes.Contains(stdout, []byte("metablock 0 at bit")) {
+		t.Errorf("inspect returned %d: %s", status, stdout)
+	}
+	status, stdout, _ = runCommand(t, compressed, "inspect", "-json")
+	if status != 0 || !bytes.Contains(stdout, []byte(`"Metablocks": [`)) {
+		t.Errorf("inspect -json returned %d: %s", status, stdout)
+	}
+}
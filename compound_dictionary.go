@@ -0,0 +1,169 @@
+package brotli
+
+import "encoding/binary"
+
+/* Copyright 2017 Google Inc. All Rights Reserved.
+
+   Distributed under MIT license.
+   See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+*/
+
+/* Custom LZ77 prefix dictionary ("compound dictionary" in shared-brotli
+   terms).
+
+   The dictionary is addressed as if it preceded the data, but just beyond the
+   sliding window: a distance of |dictionary_start| + k, where
+   |dictionary_start| is the largest distance that reaches into the window,
+   refers to the k-th byte from the end of the dictionary. Static dictionary
+   references start past the end of the prefix, so they are shifted by its
+   size (the |gap| of the backward reference search). */
+
+const (
+	compoundDictionaryMinHashBits = 8
+	compoundDictionaryMaxHashBits = 20
+	compoundDictionaryMaxChain    = 32
+)
+
+type preparedDictionary struct {
+	source    []byte
+	hash_bits uint
+
+	/* Latest position (plus one) of every hash bucket, and the previous
+	   position (plus one) with the same hash for every position. Zero ends the
+	   chain. */
+	head  []uint32
+	chain []uint32
+}
+
+func hashBytesCompound(data []byte, bits uint) uint32 {
+	var h uint32 = binary.LittleEndian.Uint32(data) * kHashMul32
+	return h >> (32 - bits)
+}
+
+/* Builds the hash chains for |source|. Positions are inserted in increasing
+   order, so every chain visits them from the smallest distance up. */
+func prepareDictionary(dict *preparedDictionary, source []byte) {
+	var bits uint = compoundDictionaryMinHashBits
+	var i uint
+	for bits < compoundDictionaryMaxHashBits && uint(1)<<bits < uint(len(source)) {
+		bits++
+	}
+
+	dict.source = source
+	dict.hash_bits = bits
+	dict.head = make([]uint32, 1<<bits)
+	dict.chain = nil
+	if len(source) < 4 {
+		return
+	}
+
+	dict.chain = make([]uint32, len(source)-3)
+	for i = 0; i+4 <= uint(len(source)); i++ {
+		var key uint32 = hashBytesCompound(source[i:], bits)
+		dict.chain[i] = dict.head[key]
+		dict.head[key] = uint32(i + 1)
+	}
+}
+
+/* Finds the longest match of the data at |cur_ix| in the dictionary and
+   stores it in |out| if it scores better than what is already there.
+   |distance_offset| is the largest distance that reaches into the window. */
+func findCompoundDictionaryMatch(dict *preparedDictionary, data []byte, ring_buffer_mask uint, distance_cache []int, cur_ix uint, max_length uint, distance_offset uint, max_distance uint, out *hasherSearchResult) {
+	var source []byte = dict.source
+	var source_size uint = uint(len(source))
+	var cur_ix_masked uint = cur_ix & ring_buffer_mask
+	var best_len uint = out.len
+	var best_score uint = out.score
+	var item uint32
+	var chain int
+	if dict.chain == nil || max_length < 4 {
+		return
+	}
+
+	/* Try the last distance first; it is cheap to encode. */
+	{
+		var backward uint = uint(distance_cache[0])
+		if backward > distance_offset && backward <= distance_offset+source_size {
+			var offset uint = distance_offset + source_size - backward
+			var limit uint = brotli_min_size_t(max_length, source_size-offset)
+			var len uint = findMatchLengthWithLimit(source[offset:], data[cur_ix_masked:], limit)
+			if len >= 3 {
+				var score uint = backwardReferenceScoreUsingLastDistance(len)
+				if best_score < score {
+					best_len = len
+					best_score = score
+					out.len = len
+					out.len_code_delta = 0
+					out.distance = backward
+					out.score = score
+				}
+			}
+		}
+	}
+
+	item = dict.head[hashBytesCompound(data[cur_ix_masked:], dict.hash_bits)]
+	for ; item != 0 && chain < compoundDictionaryMaxChain; item, chain = dict.chain[item-1], chain+1 {
+		var offset uint = uint(item - 1)
+		var distance uint = distance_offset + source_size - offset
+		var limit uint = brotli_min_size_t(max_length, source_size-offset)
+		var len uint
+		if distance > max_distance {
+			break
+		}
+
+		if best_len >= limit || data[cur_ix_masked+best_len] != source[offset+best_len] {
+			continue
+		}
+
+		len = findMatchLengthWithLimit(source[offset:], data[cur_ix_masked:], limit)
+		if len >= 4 {
+			var score uint = backwardReferenceScore(len, distance)
+			if best_score < score {
+				best_len = len
+				best_score = score
+				out.len = len
+				out.len_code_delta = 0
+				out.distance = distance
+				out.score = score
+			}
+		}
+	}
+}
+
+/* Appends to |matches| the dictionary matches of the data at |cur_ix| that
+   are longer than |*best_len|, by strictly increasing length and increasing
+   distance, and updates |*best_len|. Returns the rest of |matches|. */
+func findAllCompoundDictionaryMatches(dict *preparedDictionary, data []byte, ring_buffer_mask uint, cur_ix uint, max_length uint, distance_offset uint, max_distance uint, best_len *uint, matches []backwardMatch) []backwardMatch {
+	var source []byte = dict.source
+	var source_size uint = uint(len(source))
+	var cur_ix_masked uint = cur_ix & ring_buffer_mask
+	var item uint32
+	var chain int
+	if dict.chain == nil || max_length < 4 {
+		return matches
+	}
+
+	item = dict.head[hashBytesCompound(data[cur_ix_masked:], dict.hash_bits)]
+	for ; item != 0 && chain < compoundDictionaryMaxChain; item, chain = dict.chain[item-1], chain+1 {
+		var offset uint = uint(item - 1)
+		var distance uint = distance_offset + source_size - offset
+		var limit uint = brotli_min_size_t(max_length, source_size-offset)
+		var len uint
+		if distance > max_distance {
+			break
+		}
+
+		if *best_len >= limit || data[cur_ix_masked+*best_len] != source[offset+*best_len] {
+			continue
+		}
+
+		len = findMatchLengthWithLimit(source[offset:], data[cur_ix_masked:], limit)
+		if len > *best_len {
+			*best_len = len
+			initBackwardMatch(&matches[0], distance, len)
+			matches = matches[1:]
+		}
+	}
+
+	return matches
+}
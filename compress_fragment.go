@@ -495,7 +495,7 @@ var kCmdHistoSeed = [128]uint32{
 var compressFragmentFastImpl_kFirstBlockSize uint = 3 << 15
 var compressFragmentFastImpl_kMergeBlockSize uint = 1 << 16
 
-func compressFragmentFastImpl(in []byte, input_size uint, is_last bool, table []int, table_bits uint, cmd_depth []byte, cmd_bits []uint16, cmd_code_numbits *uint, cmd_code []byte, storage_ix *uint, storage []byte) {
+func compressFragmentFastImpl(in []byte, input_size uint, is_last bool, table []int, table_bits uint, cmd_depth []byte, cmd_bits []uint16, cmd_code_numbits *uint, cmd_code []byte, mb_log *metaBlockLog, storage_ix *uint, storage []byte) {
 	var cmd_histo [128]uint32
 	var ip_end int
 	var next_emit int = 0
@@ -524,6 +524,10 @@ func compressFragmentFastImpl(in []byte, input_size uint, is_last bool, table []
 	/* Save the bit position of the MLEN field of the meta-block header, so that
 	   we can update it later if we decide to extend this meta-block. */
 	storeMetaBlockHeader1(block_size, false, storage_ix, storage)
+	mb_log.compressed++
+	if mb_log.tracing {
+		traceMetaBlock(mb_log, simpleMetaBlockInfo(block_size, 0, 0, false), mlen_storage_ix-3)
+	}
 
 	/* No block splits, no contexts. */
 	writeBits(13, 0, storage_ix, storage)
@@ -639,6 +643,11 @@ emit_commands:
 					emitInsertLen1(insert, cmd_depth, cmd_bits, cmd_histo[:], storage_ix, storage)
 				} else if shouldUseUncompressedMode(in[metablock_start:], in[next_emit:], insert, literal_ratio) {
 					emitUncompressedMetaBlock1(in[metablock_start:], in[base:], mlen_storage_ix-3, storage_ix, storage)
+					mb_log.compressed--
+					mb_log.uncompressed++
+					if mb_log.tracing {
+						*lastTracedMetaBlock(mb_log) = simpleMetaBlockInfo(uint(base-metablock_start), 0, 0, true)
+					}
 					input_size -= uint(base - input)
 					input = base
 					next_emit = input
@@ -740,6 +749,10 @@ emit_remainder:
 		total_block_size += block_size
 
 		updateBits(20, uint32(total_block_size-1), mlen_storage_ix, storage)
+		if mb_log.tracing {
+			lastTracedMetaBlock(mb_log).InputSize = int(total_block_size)
+		}
+
 		goto emit_commands
 	}
 
@@ -751,6 +764,11 @@ emit_remainder:
 			emitLiterals(in[next_emit:], insert, lit_depth[:], lit_bits[:], storage_ix, storage)
 		} else if shouldUseUncompressedMode(in[metablock_start:], in[next_emit:], insert, literal_ratio) {
 			emitUncompressedMetaBlock1(in[metablock_start:], in[ip_end:], mlen_storage_ix-3, storage_ix, storage)
+			mb_log.compressed--
+			mb_log.uncompressed++
+			if mb_log.tracing {
+				*lastTracedMetaBlock(mb_log) = simpleMetaBlockInfo(uint(ip_end-metablock_start), 0, 0, true)
+			}
 		} else {
 			emitLongInsertLen(insert, cmd_depth, cmd_bits, cmd_histo[:], storage_ix, storage)
 			emitLiterals(in[next_emit:], insert, lit_depth[:], lit_bits[:], storage_ix, storage)
@@ -762,6 +780,10 @@ emit_remainder:
 	/* If we have more data, write a new meta-block header and prefix codes and
 	   then continue emitting commands. */
 next_block:
+	if mb_log.tracing {
+		traceMetaBlockEnd(mb_log, *storage_ix)
+	}
+
 	if input_size > 0 {
 		metablock_start = input
 		block_size = brotli_min_size_t(input_size, compressFragmentFastImpl_kFirstBlockSize)
@@ -772,6 +794,10 @@ next_block:
 		mlen_storage_ix = *storage_ix + 3
 
 		storeMetaBlockHeader1(block_size, false, storage_ix, storage)
+		mb_log.compressed++
+		if mb_log.tracing {
+			traceMetaBlock(mb_log, simpleMetaBlockInfo(block_size, 0, 0, false), mlen_storage_ix-3)
+		}
 
 		/* No block splits, no contexts. */
 		writeBits(13, 0, storage_ix, storage)
@@ -813,8 +839,9 @@ next_block:
    REQUIRES: "table_size" is an odd (9, 11, 13, 15) power of two
    OUTPUT: maximal copy distance <= |input_size|
    OUTPUT: maximal copy distance <= BROTLI_MAX_BACKWARD_LIMIT(18) */
-func compressFragmentFast(input []byte, input_size uint, is_last bool, table []int, table_size uint, cmd_depth []byte, cmd_bits []uint16, cmd_code_numbits *uint, cmd_code []byte, storage_ix *uint, storage []byte) {
+func compressFragmentFast(input []byte, input_size uint, is_last bool, table []int, table_size uint, cmd_depth []byte, cmd_bits []uint16, cmd_code_numbits *uint, cmd_code []byte, mb_log *metaBlockLog, storage_ix *uint, storage []byte) {
 	var initial_storage_ix uint = *storage_ix
+	var initial_log metaBlockLog = *mb_log
 	var table_bits uint = uint(log2FloorNonZero(table_size))
 
 	if input_size == 0 {
@@ -825,11 +852,17 @@ func compressFragmentFast(input []byte, input_size uint, is_last bool, table []i
 		return
 	}
 
-	compressFragmentFastImpl(input, input_size, is_last, table, table_bits, cmd_depth, cmd_bits, cmd_code_numbits, cmd_code, storage_ix, storage)
+	compressFragmentFastImpl(input, input_size, is_last, table, table_bits, cmd_depth, cmd_bits, cmd_code_numbits, cmd_code, mb_log, storage_ix, storage)
 
 	/* If output is larger than single uncompressed block, rewrite it. */
 	if *storage_ix-initial_storage_ix > 31+(input_size<<3) {
 		emitUncompressedMetaBlock1(input, input[input_size:], initial_storage_ix, storage_ix, storage)
+		*mb_log = initial_log
+		mb_log.uncompressed++
+		if mb_log.tracing {
+			traceMetaBlock(mb_log, simpleMetaBlockInfo(input_size, 0, 0, true), initial_storage_ix)
+			traceMetaBlockEnd(mb_log, *storage_ix)
+		}
 	}
 
 	if is_last {
@@ -679,7 +679,7 @@ func emitUncompressedMetaBlock(input []byte, input_size uint, storage_ix *uint,
 	storage[*storage_ix>>3] = 0
 }
 
-func compressFragmentTwoPassImpl(input []byte, input_size uint, is_last bool, command_buf []uint32, literal_buf []byte, table []int, table_bits uint, min_match uint, storage_ix *uint, storage []byte) {
+func compressFragmentTwoPassImpl(input []byte, input_size uint, is_last bool, command_buf []uint32, literal_buf []byte, table []int, table_bits uint, min_match uint, mb_log *metaBlockLog, storage_ix *uint, storage []byte) {
 	/* Save the start of the first block for position and distance computations.
 	 */
 	var base_ip []byte = input
@@ -693,7 +693,12 @@ func compressFragmentTwoPassImpl(input []byte, input_size uint, is_last bool, co
 		num_literals = uint(-cap(literals) + cap(literal_buf))
 		if shouldCompress(input, block_size, num_literals) {
 			var num_commands uint = uint(-cap(commands) + cap(command_buf))
+			if mb_log.tracing {
+				traceMetaBlock(mb_log, simpleMetaBlockInfo(block_size, num_commands, num_literals, false), *storage_ix)
+			}
+
 			storeMetaBlockHeader(block_size, false, storage_ix, storage)
+			mb_log.compressed++
 
 			/* No block splits, no contexts. */
 			writeBits(13, 0, storage_ix, storage)
@@ -703,7 +708,16 @@ func compressFragmentTwoPassImpl(input []byte, input_size uint, is_last bool, co
 			/* Since we did not find many backward references and the entropy of
 			   the data is close to 8 bits, we can simply emit an uncompressed block.
 			   This makes compression speed of uncompressible data about 3x faster. */
+			if mb_log.tracing {
+				traceMetaBlock(mb_log, simpleMetaBlockInfo(block_size, uint(-cap(commands)+cap(command_buf)), num_literals, true), *storage_ix)
+			}
+
 			emitUncompressedMetaBlock(input, block_size, storage_ix, storage)
+			mb_log.uncompressed++
+		}
+
+		if mb_log.tracing {
+			traceMetaBlockEnd(mb_log, *storage_ix)
 		}
 
 		input = input[block_size:]
@@ -724,8 +738,9 @@ func compressFragmentTwoPassImpl(input []byte, input_size uint, is_last bool, co
    REQUIRES: "table_size" is a power of two
    OUTPUT: maximal copy distance <= |input_size|
    OUTPUT: maximal copy distance <= BROTLI_MAX_BACKWARD_LIMIT(18) */
-func compressFragmentTwoPass(input []byte, input_size uint, is_last bool, command_buf []uint32, literal_buf []byte, table []int, table_size uint, storage_ix *uint, storage []byte) {
+func compressFragmentTwoPass(input []byte, input_size uint, is_last bool, command_buf []uint32, literal_buf []byte, table []int, table_size uint, mb_log *metaBlockLog, storage_ix *uint, storage []byte) {
 	var initial_storage_ix uint = *storage_ix
+	var initial_log metaBlockLog = *mb_log
 	var table_bits uint = uint(log2FloorNonZero(table_size))
 	var min_match uint
 	if table_bits <= 15 {
@@ -733,12 +748,18 @@ func compressFragmentTwoPass(input []byte, input_size uint, is_last bool, comman
 	} else {
 		min_match = 6
 	}
-	compressFragmentTwoPassImpl(input, input_size, is_last, command_buf, literal_buf, table, table_bits, min_match, storage_ix, storage)
+	compressFragmentTwoPassImpl(input, input_size, is_last, command_buf, literal_buf, table, table_bits, min_match, mb_log, storage_ix, storage)
 
 	/* If output is larger than single uncompressed block, rewrite it. */
 	if *storage_ix-initial_storage_ix > 31+(input_size<<3) {
 		rewindBitPosition(initial_storage_ix, storage_ix, storage)
 		emitUncompressedMetaBlock(input, input_size, storage_ix, storage)
+		*mb_log = initial_log
+		mb_log.uncompressed++
+		if mb_log.tracing {
+			traceMetaBlock(mb_log, simpleMetaBlockInfo(input_size, 0, 0, true), initial_storage_ix)
+			traceMetaBlockEnd(mb_log, *storage_ix)
+		}
 	}
 
 	if is_last {
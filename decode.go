@@ -39,6 +39,7 @@ const (
 	decoderErrorFormatPadding1              = -14
 	decoderErrorFormatPadding2              = -15
 	decoderErrorFormatDistance              = -16
+	decoderErrorCompoundDictionary          = -18
 	decoderErrorDictionaryNotSet            = -19
 	decoderErrorInvalidArguments            = -20
 	decoderErrorAllocContextModes           = -21
@@ -48,6 +49,16 @@ const (
 	decoderErrorAllocRingBuffer2            = -27
 	decoderErrorAllocBlockTypeTrees         = -30
 	decoderErrorUnreachable                 = -31
+
+	/* Not in the reference decoder: the output grew past
+	   ReaderOptions.MaxDecodedSize, or the window is larger than
+	   ReaderOptions.MaxWindowBits. */
+	decoderErrorOutputLimit = -32
+	decoderErrorWindowLimit = -33
+
+	/* Not in the reference decoder: the payload of a metadata block, kept for
+	   ReaderOptions.MetadataCallback, would exceed ReaderOptions.MemoryLimit. */
+	decoderErrorAllocMetadata = -34
 )
 
 /**
@@ -57,7 +68,7 @@ const (
  * to @c -1. There are also 4 other possible non-error codes @c 0 .. @c 3 in
  * ::BrotliDecoderErrorCode enumeration.
  */
-const lastErrorCode = decoderErrorUnreachable
+const lastErrorCode = decoderErrorAllocMetadata
 
 /** Options to be used with ::BrotliDecoderSetParameter. */
 const (
@@ -813,6 +824,10 @@ func readHuffmanCode(alphabet_size uint32, max_symbol uint32, table []huffmanCod
 				s.symbol += bits
 			}
 
+			if s.inspector != nil {
+				inspectPrefixCode(s, alphabet_size, true)
+			}
+
 			table_size = buildSimpleHuffmanTable(table, huffmanTableBits, s.symbols_lists_array[:], s.symbol)
 			if opt_table_size != nil {
 				*opt_table_size = table_size
@@ -864,6 +879,10 @@ func readHuffmanCode(alphabet_size uint32, max_symbol uint32, table []huffmanCod
 				return decoderErrorFormatHuffmanSpace
 			}
 
+			if s.inspector != nil {
+				inspectPrefixCode(s, alphabet_size, false)
+			}
+
 			table_size = buildHuffmanTable(table, huffmanTableBits, s.symbol_lists, s.code_length_histo[:])
 			if opt_table_size != nil {
 				*opt_table_size = table_size
@@ -994,6 +1013,11 @@ func decodeContextMap(context_map_size uint32, num_htrees *uint32, context_map_a
 
 		(*num_htrees)++
 		s.context_index = 0
+		*context_map_arg = nil
+		if !decoderCheckMemory(s, int(context_map_size)) {
+			return decoderErrorAllocContextMap
+		}
+
 		*context_map_arg = make([]byte, uint(context_map_size))
 		if *context_map_arg == nil {
 			return decoderErrorAllocContextMap
@@ -1167,6 +1191,10 @@ func decodeBlockTypeAndLength(safe int, s *Reader, tree_type int) bool {
 
 	ringbuffer[0] = ringbuffer[1]
 	ringbuffer[1] = block_type
+	if s.inspector != nil {
+		inspectBlockSwitch(s, tree_type, block_type)
+	}
+
 	return true
 }
 
@@ -1283,6 +1311,13 @@ func writeRingBuffer(s *Reader, available_out *uint, next_out *[]byte, total_out
 	var start []byte
 	start = s.ringbuffer[s.partial_pos_out&uint(s.ringbuffer_mask):]
 	var to_write uint = unwrittenBytes(s, true)
+	var limited bool = false
+	if s.options.MaxDecodedSize > 0 && uint64(s.partial_pos_out+to_write) > uint64(s.options.MaxDecodedSize) {
+		/* Hand out the output up to the limit, then fail. */
+		to_write = uint(s.options.MaxDecodedSize) - s.partial_pos_out
+		limited = true
+	}
+
 	var num_written uint = *available_out
 	if num_written > to_write {
 		num_written = to_write
@@ -1307,6 +1342,10 @@ func writeRingBuffer(s *Reader, available_out *uint, next_out *[]byte, total_out
 		*total_out = s.partial_pos_out
 	}
 
+	if limited && num_written == to_write {
+		return decoderErrorOutputLimit
+	}
+
 	if num_written < to_write {
 		if s.ringbuffer_size == 1<<s.window_bits || force {
 			return decoderNeedsMoreOutput
@@ -1345,27 +1384,30 @@ func wrapRingBuffer(s *Reader) {
    could be done uniformly for the first two and all other positions. */
 func ensureRingBuffer(s *Reader) bool {
 	var old_ringbuffer []byte = s.ringbuffer
+	var size uint = uint(s.new_ringbuffer_size) + uint(kRingBufferWriteAheadSlack)
 	if s.ringbuffer_size == s.new_ringbuffer_size {
 		return true
 	}
 
-	s.ringbuffer = make([]byte, uint(s.new_ringbuffer_size)+uint(kRingBufferWriteAheadSlack))
-	if s.ringbuffer == nil {
-		/* Restore previous value. */
-		s.ringbuffer = old_ringbuffer
-
-		return false
-	}
+	if uint(cap(old_ringbuffer)) >= size {
+		/* Grow in place; the already decoded bytes stay where they are. */
+		s.ringbuffer = old_ringbuffer[:size]
+	} else {
+		s.ringbuffer = make([]byte, size)
+		if s.ringbuffer == nil {
+			/* Restore previous value. */
+			s.ringbuffer = old_ringbuffer
 
-	s.ringbuffer[s.new_ringbuffer_size-2] = 0
-	s.ringbuffer[s.new_ringbuffer_size-1] = 0
+			return false
+		}
 
-	if !(old_ringbuffer == nil) {
 		copy(s.ringbuffer, old_ringbuffer[:uint(s.pos)])
-
 		old_ringbuffer = nil
 	}
 
+	s.ringbuffer[s.new_ringbuffer_size-2] = 0
+	s.ringbuffer[s.new_ringbuffer_size-1] = 0
+
 	s.ringbuffer_size = s.new_ringbuffer_size
 	s.ringbuffer_mask = s.new_ringbuffer_size - 1
 	s.ringbuffer_end = s.ringbuffer[s.ringbuffer_size:]
@@ -1458,7 +1500,7 @@ func calculateRingBufferSize(s *Reader) {
 		return
 	}
 
-	if s.ringbuffer == nil {
+	if s.ringbuffer_size == 0 {
 		output_size = 0
 	} else {
 		output_size = s.pos
@@ -1481,6 +1523,43 @@ func calculateRingBufferSize(s *Reader) {
 	s.new_ringbuffer_size = new_ringbuffer_size
 }
 
+/* Sizes in bytes of a huffmanCode and of a slice header, for memory
+   accounting. */
+const (
+	huffmanCodeSize = 4
+	sliceHeaderSize = 24
+)
+
+func huffmanTreeGroupMemory(group *huffmanTreeGroup) int {
+	return cap(group.codes)*huffmanCodeSize + cap(group.htrees)*sliceHeaderSize
+}
+
+/* Returns the memory held for the ring buffer, at the size the current
+   metablock needs, for the Huffman tree groups, block type trees, context
+   modes and context maps, and for the payload of metadata blocks.
+   While the ring buffer still has to grow, the old and the new buffer both
+   exist during the copy, so both are counted. */
+func decoderMemoryUsage(s *Reader) int {
+	var ringbuffer int = cap(s.ringbuffer)
+	if s.new_ringbuffer_size+int(kRingBufferWriteAheadSlack) > ringbuffer {
+		ringbuffer += s.new_ringbuffer_size + int(kRingBufferWriteAheadSlack)
+	}
+
+	var tables int = huffmanTreeGroupMemory(&s.literal_hgroup) + huffmanTreeGroupMemory(&s.insert_copy_hgroup) + huffmanTreeGroupMemory(&s.distance_hgroup) + cap(s.block_type_trees)*huffmanCodeSize
+	var context_maps int = cap(s.context_modes) + cap(s.context_map) + cap(s.dist_context_map)
+	return ringbuffer + tables + context_maps + cap(s.metadata)
+}
+
+/* Reports whether the decoder stays within ReaderOptions.MemoryLimit after
+   allocating |extra| more bytes. */
+func decoderCheckMemory(s *Reader, extra int) bool {
+	if s.options.MemoryLimit <= 0 {
+		return true
+	}
+
+	return int64(decoderMemoryUsage(s)+extra) <= s.options.MemoryLimit
+}
+
 /* Reads 1..256 2-bit context modes. */
 func readContextModes(s *Reader) int {
 	var br *bitReader = &s.br
@@ -1902,9 +1981,11 @@ CommandPostDecodeLiterals:
 
 	i = s.copy_length
 
-	/* Apply copy of LZ77 back-reference, or static dictionary reference if
-	   the distance is larger than the max LZ77 distance */
+	/* Apply copy of LZ77 back-reference, or custom / static dictionary
+	   reference if the distance is larger than the max LZ77 distance */
 	if s.distance_code > s.max_distance {
+		var address int = s.distance_code - s.max_distance - 1 - len(s.options.Dictionary)
+
 		/* The maximum allowed distance is BROTLI_MAX_ALLOWED_DISTANCE = 0x7FFFFFFC.
 		   With this choice, no signed overflow can occur after decoding
 		   a special distance code (e.g., after adding 3 to the last distance). */
@@ -1912,8 +1993,18 @@ CommandPostDecodeLiterals:
 			return decoderErrorFormatDistance
 		}
 
-		if i >= minDictionaryWordLength && i <= maxDictionaryWordLength {
-			var address int = s.distance_code - s.max_distance - 1
+		if address < 0 {
+			/* The custom dictionary sits just beyond the window. */
+			if !initializeCompoundDictionaryCopy(s, -address-1, i) {
+				return decoderErrorCompoundDictionary
+			}
+
+			pos += copyFromCompoundDictionary(s, pos)
+			if pos >= s.ringbuffer_size {
+				s.state = stateCommandPostWrite1
+				goto saveStateAndReturn
+			}
+		} else if i >= minDictionaryWordLength && i <= maxDictionaryWordLength {
 			var words *dictionary = s.dictionary
 			var trans *transforms = s.transforms
 			var offset int = int(s.dictionary.offsets_by_length[i])
@@ -2035,6 +2126,36 @@ saveStateAndReturn:
 	return result
 }
 
+func initializeCompoundDictionaryCopy(s *Reader, address int, length int) bool {
+	if len(s.options.Dictionary) < address+length {
+		return false
+	}
+
+	/* Update the recent distances cache. */
+	s.dist_rb[s.dist_rb_idx&3] = s.distance_code
+
+	s.dist_rb_idx++
+	s.meta_block_remaining_len -= length
+	s.compound_offset = address
+	s.compound_remaining = length
+	return true
+}
+
+/* Copies as much of the pending custom dictionary reference as fits before
+   the end of the ring buffer. Returns the number of bytes copied. */
+func copyFromCompoundDictionary(s *Reader, pos int) int {
+	var length int = s.compound_remaining
+	var space int = s.ringbuffer_size - pos
+	if length > space {
+		length = space
+	}
+
+	copy(s.ringbuffer[pos:pos+length], s.options.Dictionary[s.compound_offset:])
+	s.compound_offset += length
+	s.compound_remaining -= length
+	return length
+}
+
 func processCommands(s *Reader) int {
 	return processCommandsInternal(0, s)
 }
@@ -2060,6 +2181,27 @@ func maxDistanceSymbol(ndirect uint32, npostfix uint32) uint32 {
 	}
 }
 
+/* Records where the decoder failed. |taken| is the number of bytes moved
+   from the caller's input into the internal buffer during this call, and
+   |buffered| the number of bytes that were in that buffer before it. */
+func saveErrorPosition(s *Reader, taken uint, buffered uint32) {
+	var br *bitReader = &s.br
+	var input_start uint64
+	if s.buffer_length != 0 {
+		/* Reading from the internal buffer, whose bytes were consumed from the
+		   caller before this call. */
+		input_start = s.total_in - uint64(buffered)
+	} else {
+		input_start = s.total_in + uint64(taken)
+	}
+
+	s.error_position = (input_start+uint64(br.byte_pos))*8 - uint64(getAvailableBits(br))
+	s.error_output_position = uint64(s.partial_pos_out)
+	if s.ringbuffer_size != 0 {
+		s.error_output_position += uint64(unwrittenBytes(s, false))
+	}
+}
+
 /* Invariant: input stream is never overconsumed:
    - invalid input implies that the whole stream is invalid -> any amount of
      input could be read and discarded
@@ -2074,6 +2216,8 @@ func maxDistanceSymbol(ndirect uint32, npostfix uint32) uint32 {
 func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, available_out *uint, next_out *[]byte) int {
 	var result int = decoderSuccess
 	var br *bitReader = &s.br
+	var orig_available_in uint = *available_in
+	var orig_buffer_length uint32 = s.buffer_length
 
 	/* Do not try to process further in a case of unrecoverable error. */
 	if int(s.error_code) < 0 {
@@ -2106,12 +2250,13 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 		if result != decoderSuccess {
 			/* Error, needs more input/output. */
 			if result == decoderNeedsMoreInput {
-				if s.ringbuffer != nil { /* Pro-actively push output. */
+				if s.ringbuffer_size != 0 { /* Pro-actively push output. */
 					var intermediate_result int = writeRingBuffer(s, available_out, next_out, nil, true)
 
 					/* WriteRingBuffer checks s->meta_block_remaining_len validity. */
 					if int(intermediate_result) < 0 {
 						result = intermediate_result
+						saveErrorPosition(s, orig_available_in-*available_in, orig_buffer_length)
 						break
 					}
 				}
@@ -2167,6 +2312,10 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 			/* Unreachable. */
 
 			/* Fail or needs more output. */
+			if result < 0 {
+				saveErrorPosition(s, orig_available_in-*available_in, orig_buffer_length)
+			}
+
 			if s.buffer_length != 0 {
 				/* Just consumed the buffered input and produced some output. Otherwise
 				   it would result in "needs more input". Reset internal buffer. */
@@ -2222,10 +2371,23 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 			/* Maximum distance, see section 9.1. of the spec. */
 		/* Fall through. */
 		case stateInitialize:
+			if s.options.MaxWindowBits > 0 && s.window_bits > uint32(s.options.MaxWindowBits) {
+				result = decoderErrorWindowLimit
+				break
+			}
+
 			s.max_backward_distance = (1 << s.window_bits) - windowGap
 
-			/* Allocate memory for both block_type_trees and block_len_trees. */
-			s.block_type_trees = make([]huffmanCode, (3 * (huffmanMaxSize258 + huffmanMaxSize26)))
+			/* Allocate memory for both block_type_trees and block_len_trees,
+			   unless a previous stream already did. */
+			if s.block_type_trees == nil {
+				if !decoderCheckMemory(s, 3*(huffmanMaxSize258+huffmanMaxSize26)*huffmanCodeSize) {
+					result = decoderErrorAllocBlockTypeTrees
+					break
+				}
+
+				s.block_type_trees = make([]huffmanCode, (3 * (huffmanMaxSize258 + huffmanMaxSize26)))
+			}
 
 			if s.block_type_trees == nil {
 				result = decoderErrorAllocBlockTypeTrees
@@ -2240,6 +2402,9 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 			/* Fall through. */
 		case stateMetablockBegin:
 			decoderStateMetablockBegin(s)
+			if s.inspector != nil {
+				inspectMetablockBegin(s)
+			}
 
 			s.state = stateMetablockHeader
 			fallthrough
@@ -2252,6 +2417,10 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 				break
 			}
 
+			if s.inspector != nil {
+				inspectMetablockHeader(s)
+			}
+
 			if s.is_metadata != 0 || s.is_uncompressed != 0 {
 				if !bitReaderJumpToByteBoundary(br) {
 					result = decoderErrorFormatPadding1
@@ -2270,6 +2439,11 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 			}
 
 			calculateRingBufferSize(s)
+			if !decoderCheckMemory(s, 0) {
+				result = decoderErrorAllocRingBuffer1
+				break
+			}
+
 			if s.is_uncompressed != 0 {
 				s.state = stateUncompressed
 				break
@@ -2285,17 +2459,51 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 			}
 
 		case stateMetadata:
+			if s.options.MetadataCallback != nil && s.ringbuffer_size != 0 {
+				/* Push out everything decoded so far, so that the callback sees
+				   metadata in stream order. */
+				result = writeRingBuffer(s, available_out, next_out, nil, true)
+				if result != decoderSuccess {
+					break
+				}
+
+				wrapRingBuffer(s)
+			}
+
+			if s.options.MetadataCallback != nil && len(s.metadata)+s.meta_block_remaining_len > cap(s.metadata) {
+				/* The payload is kept for the callback until the block ends, so
+				   it is allocated at its full size, once the memory limit allows
+				   it. */
+				var size int = len(s.metadata) + s.meta_block_remaining_len
+				if !decoderCheckMemory(s, size-cap(s.metadata)) {
+					result = decoderErrorAllocMetadata
+					break
+				}
+
+				s.metadata = append(make([]byte, 0, size), s.metadata...)
+			}
+
 			for ; s.meta_block_remaining_len > 0; s.meta_block_remaining_len-- {
 				var bits uint32
 
-				/* Read one byte and ignore it. */
+				/* Read one byte; keep it only if somebody wants it. */
 				if !safeReadBits(br, 8, &bits) {
 					result = decoderNeedsMoreInput
 					break
 				}
+
+				s.metadata_bytes++
+				if s.options.MetadataCallback != nil {
+					s.metadata = append(s.metadata, byte(bits))
+				}
 			}
 
 			if result == decoderSuccess {
+				if s.options.MetadataCallback != nil && len(s.metadata) != 0 {
+					s.options.MetadataCallback(int64(s.partial_pos_out), s.metadata)
+					s.metadata = s.metadata[:0]
+				}
+
 				s.state = stateMetablockDone
 			}
 
@@ -2367,6 +2575,12 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 				bits >>= 2
 				s.num_direct_distance_codes = numDistanceShortCodes + (bits << s.distance_postfix_bits)
 				s.distance_postfix_mask = int(bitMask(s.distance_postfix_bits))
+				s.context_modes = nil
+				if !decoderCheckMemory(s, int(s.num_block_types[0])) {
+					result = decoderErrorAllocContextModes
+					break
+				}
+
 				s.context_modes = make([]byte, uint(s.num_block_types[0]))
 				if s.context_modes == nil {
 					result = decoderErrorAllocContextModes
@@ -2457,6 +2671,10 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 			}
 			s.loop_counter++
 			if s.loop_counter >= 3 {
+				if s.inspector != nil {
+					inspectTreeGroups(s)
+				}
+
 				prepareLiteralDecoding(s)
 				s.dist_context_map_slice = s.dist_context_map
 				s.htree_command = []huffmanCode(s.insert_copy_hgroup.htrees[0])
@@ -2488,6 +2706,13 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 			}
 
 			if s.state == stateCommandPostWrite1 {
+				if s.compound_remaining != 0 {
+					s.pos += copyFromCompoundDictionary(s, s.pos)
+					if s.pos >= s.ringbuffer_size {
+						break
+					}
+				}
+
 				if s.meta_block_remaining_len == 0 {
 					/* Next metablock, if any. */
 					s.state = stateMetablockDone
@@ -2519,6 +2744,7 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 			}
 
 			decoderStateCleanupAfterMetablock(s)
+			s.metablock_count++
 			if s.is_last_metablock == 0 {
 				s.state = stateMetablockBegin
 				break
@@ -2539,7 +2765,7 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 			fallthrough
 
 		case stateDone:
-			if s.ringbuffer != nil {
+			if s.ringbuffer_size != 0 {
 				result = writeRingBuffer(s, available_out, next_out, nil, true)
 				if result != decoderSuccess {
 					break
@@ -2559,7 +2785,92 @@ func decoderHasMoreOutput(s *Reader) bool {
 		return false
 	}
 
-	return s.ringbuffer != nil && unwrittenBytes(s, false) != 0
+	return s.ringbuffer_size != 0 && unwrittenBytes(s, false) != 0
+}
+
+/* Returns the decoded data that has not been handed out yet, straight from
+   the ring buffer, and marks it as handed out. At most |*size| bytes are
+   returned, or any amount if |*size| is 0; |*size| is set to the length of
+   the result. The result is only valid until the next call to
+   decoderDecompressStream. It is meant to be used with |*available_out| = 0
+   in decoderDecompressStream, which then decodes as much as fits in the ring
+   buffer. */
+func decoderTakeOutput(s *Reader, size *uint) []byte {
+	var result []byte = nil
+	var available_out uint
+	if *size != 0 {
+		available_out = *size
+	} else {
+		available_out = 1 << 24
+	}
+	var requested_out uint = available_out
+	var status int
+	if s.ringbuffer_size == 0 || int(s.error_code) < 0 {
+		*size = 0
+		return nil
+	}
+
+	wrapRingBuffer(s)
+	status = writeRingBuffer(s, &available_out, &result, nil, true)
+
+	/* Either WriteRingBuffer returns those "success" codes... Reaching
+	   MaxDecodedSize is not an error yet: the data up to the limit is handed
+	   out, and the next call to decoderDecompressStream fails. */
+	if status == decoderSuccess || status == decoderNeedsMoreOutput || status == decoderErrorOutputLimit {
+		*size = requested_out - available_out
+	} else {
+		/* ... or stream is broken. Normally this should be caught by
+		   decoderDecompressStream, this is just a safeguard. */
+		if int(status) < 0 {
+			saveErrorCode(s, status)
+		}
+		*size = 0
+		result = nil
+	}
+
+	return result[:*size]
+}
+
+/* Prepares a fresh decoder to decode data that comes |stream_offset| bytes
+   into a stream with a window of 2^|window_bits| bytes, whose header and
+   earlier meta-blocks are not decoded (see seekable.go). The data must not
+   refer back past its start, except into the dictionaries, as is the case
+   for the output of encoderContinueStream. |prev| holds the (up to) two
+   bytes before the data, which give the context of its first literals.
+
+   Static and custom dictionary references are numbered from the position in
+   the stream, so the ring buffer is allocated at its full size and the
+   decoder is put at that position, with nothing left to write out. */
+func decoderContinueStream(s *Reader, window_bits uint32, stream_offset uint64, prev []byte) int {
+	var i int
+	s.window_bits = window_bits
+	s.state = stateInitialize
+	if stream_offset == 0 {
+		return decoderSuccess
+	}
+
+	if s.options.MaxWindowBits > 0 && window_bits > uint32(s.options.MaxWindowBits) {
+		return decoderErrorWindowLimit
+	}
+
+	s.max_backward_distance = (1 << window_bits) - windowGap
+	s.new_ringbuffer_size = 1 << window_bits
+	if !decoderCheckMemory(s, 0) || !ensureRingBuffer(s) {
+		return decoderErrorAllocRingBuffer1
+	}
+
+	if stream_offset < uint64(s.max_backward_distance) {
+		s.pos = int(stream_offset)
+	} else {
+		s.max_distance = s.max_backward_distance
+	}
+
+	s.partial_pos_out = uint(s.pos)
+	for i = 1; i <= 2 && i <= len(prev); i++ {
+		s.ringbuffer[(s.pos-i)&s.ringbuffer_mask] = prev[len(prev)-i]
+	}
+
+	return decoderSuccess
 }
 
 func decoderGetErrorCode(s *Reader) int {
@@ -2608,6 +2919,8 @@ func decoderErrorString(c int) string {
 		return "PADDING_2"
 	case decoderErrorFormatDistance:
 		return "DISTANCE"
+	case decoderErrorCompoundDictionary:
+		return "COMPOUND_DICTIONARY"
 	case decoderErrorDictionaryNotSet:
 		return "DICTIONARY_NOT_SET"
 	case decoderErrorInvalidArguments:
@@ -2626,6 +2939,12 @@ func decoderErrorString(c int) string {
 		return "BLOCK_TYPE_TREES"
 	case decoderErrorUnreachable:
 		return "UNREACHABLE"
+	case decoderErrorOutputLimit:
+		return "OUTPUT_LIMIT"
+	case decoderErrorWindowLimit:
+		return "WINDOW_LIMIT"
+	case decoderErrorAllocMetadata:
+		return "METADATA"
 	default:
 		return "INVALID"
 	}
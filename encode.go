@@ -71,8 +71,71 @@ const (
 	streamMetadataBody   = 4
 )
 
+/* Meta-blocks carrying data that have been written so far. Metadata, padding
+   and empty last meta-blocks are not counted. */
+type metaBlockLog struct {
+	compressed   uint64
+	uncompressed uint64
+
+	/* If |tracing| is set, the meta-blocks written by the current call of a
+	   compression function are also recorded in |records|; |record_start| is
+	   the bit position of the header of the last one. |traced_pos| is the
+	   input position of the next meta-block to be reported. */
+	tracing      bool
+	records      []MetablockInfo
+	record_start uint
+	traced_pos   uint64
+}
+
+/* Records a meta-block whose header starts at bit |start|. */
+func traceMetaBlock(mb_log *metaBlockLog, info MetablockInfo, start uint) {
+	mb_log.records = append(mb_log.records, info)
+	mb_log.record_start = start
+}
+
+/* Records the bit position at which the last recorded meta-block ends. */
+func traceMetaBlockEnd(mb_log *metaBlockLog, end uint) {
+	mb_log.records[len(mb_log.records)-1].OutputBits = int(end - mb_log.record_start)
+}
+
+func lastTracedMetaBlock(mb_log *metaBlockLog) *MetablockInfo {
+	return &mb_log.records[len(mb_log.records)-1]
+}
+
+/* Returns the record of a meta-block that is stored uncompressed, or that
+   uses no block splits and no context modeling. */
+func simpleMetaBlockInfo(input_size uint, num_commands uint, num_literals uint, is_uncompressed bool) MetablockInfo {
+	var info = MetablockInfo{InputSize: int(input_size), Commands: int(num_commands), Literals: int(num_literals), Uncompressed: is_uncompressed, ContextMode: ContextNone}
+	if !is_uncompressed {
+		info.LiteralBlockTypes = 1
+		info.CommandBlockTypes = 1
+		info.DistanceBlockTypes = 1
+		info.LiteralHistograms = 1
+		info.CommandHistograms = 1
+		info.DistanceHistograms = 1
+	}
+
+	return info
+}
+
+/* Passes the meta-blocks recorded since the last call to the callback of
+   the Writer's options. */
+func reportMetaBlocks(s *Writer) {
+	var mb_log *metaBlockLog = &s.metablocks_
+	for i := range mb_log.records {
+		mb_log.records[i].Offset = int64(mb_log.traced_pos)
+		mb_log.traced_pos += uint64(mb_log.records[i].InputSize)
+		s.options.MetablockTrace(mb_log.records[i])
+	}
+
+	mb_log.records = mb_log.records[:0]
+}
+
 type Writer struct {
-	dst io.Writer
+	dst        io.Writer
+	options    WriterOptions
+	dictionary preparedDictionary // from options.Dictionary; kept across Reset
+	parallel   *parallelWriter    // when options.ChunkSize > 0
 
 	params              encoderParams
 	hasher_             hasherHandle
@@ -113,6 +176,11 @@ type Writer struct {
 	stream_state_             int
 	is_last_block_emitted_    bool
 	is_initialized_           bool
+
+	/* For Writer.Stats. */
+	bytes_in_   uint64
+	metablocks_ metaBlockLog
+	flushes_    uint64
 }
 
 func inputBlockSize(s *Writer) uint {
@@ -925,19 +993,33 @@ func shouldCompress_encode(data []byte, mask uint, last_flush_pos uint64, bytes
 func chooseContextMode(params *encoderParams, data []byte, pos uint, mask uint, length uint) int {
 	/* We only do the computation for the option of something else than
 	   CONTEXT_UTF8 for the highest qualities */
-	if params.quality >= minQualityForHqBlockSplitting && !isMostlyUTF8(data, pos, mask, length, kMinUTF8Ratio) {
+	if params.quality < minQualityForHqBlockSplitting {
+		return contextUTF8
+	}
+
+	/* When the caller told us what kind of data this is, trust it instead of
+	   sniffing the input. */
+	switch params.mode {
+	case modeText:
+		return contextUTF8
+	case modeFont:
+		return contextSigned
+	}
+
+	if !isMostlyUTF8(data, pos, mask, length, kMinUTF8Ratio) {
 		return contextSigned
 	}
 
 	return contextUTF8
 }
 
-func writeMetaBlockInternal(data []byte, mask uint, last_flush_pos uint64, bytes uint, is_last bool, literal_context_mode int, params *encoderParams, prev_byte byte, prev_byte2 byte, num_literals uint, num_commands uint, commands []command, saved_dist_cache []int, dist_cache []int, storage_ix *uint, storage []byte) {
+func writeMetaBlockInternal(data []byte, mask uint, last_flush_pos uint64, bytes uint, is_last bool, literal_context_mode int, params *encoderParams, prev_byte byte, prev_byte2 byte, num_literals uint, num_commands uint, commands []command, saved_dist_cache []int, dist_cache []int, mb_log *metaBlockLog, storage_ix *uint, storage []byte) {
 	var wrapped_last_flush_pos uint32 = wrapPosition(last_flush_pos)
 	var last_bytes uint16
 	var last_bytes_bits byte
 	var literal_context_lut contextLUT = getContextLUT(literal_context_mode)
 	var block_params encoderParams = *params
+	var info *MetablockInfo = nil
 
 	if bytes == 0 {
 		/* Write the ISLAST and ISEMPTY bits. */
@@ -947,12 +1029,29 @@ func writeMetaBlockInternal(data []byte, mask uint, last_flush_pos uint64, bytes
 		return
 	}
 
+	if mb_log.tracing {
+		traceMetaBlock(mb_log, simpleMetaBlockInfo(bytes, num_commands, num_literals, false), *storage_ix)
+		info = lastTracedMetaBlock(mb_log)
+		if params.quality >= minQualityForBlockSplit {
+			info.ContextMode = ContextMode(literal_context_mode)
+		}
+	}
+
 	if !shouldCompress_encode(data, mask, last_flush_pos, bytes, num_literals, num_commands) {
 		/* Restore the distance cache, as its last update by
 		   CreateBackwardReferences is now unused. */
 		copy(dist_cache, saved_dist_cache[:4])
 
 		storeUncompressedMetaBlock(is_last, data, uint(wrapped_last_flush_pos), mask, bytes, storage_ix, storage)
+		mb_log.uncompressed++
+		if info != nil {
+			*info = simpleMetaBlockInfo(bytes, num_commands, num_literals, true)
+			if params.quality >= minQualityForBlockSplit {
+				info.ContextMode = ContextMode(literal_context_mode)
+			}
+			traceMetaBlockEnd(mb_log, *storage_ix)
+		}
+
 		return
 	}
 
@@ -991,9 +1090,24 @@ func writeMetaBlockInternal(data []byte, mask uint, last_flush_pos uint64, bytes
 		}
 
 		storeMetaBlock(data, uint(wrapped_last_flush_pos), bytes, mask, prev_byte, prev_byte2, is_last, &block_params, literal_context_mode, commands, num_commands, &mb, storage_ix, storage)
+		if info != nil {
+			info.LiteralBlockTypes = int(mb.literal_split.num_types)
+			info.CommandBlockTypes = int(mb.command_split.num_types)
+			info.DistanceBlockTypes = int(mb.distance_split.num_types)
+			info.LiteralHistograms = int(mb.literal_histograms_size)
+			info.CommandHistograms = int(mb.command_histograms_size)
+			info.DistanceHistograms = int(mb.distance_histograms_size)
+		}
+
 		destroyMetaBlockSplit(&mb)
 	}
 
+	mb_log.compressed++
+	if info != nil {
+		info.DistancePostfixBits = int(block_params.dist.distance_postfix_bits)
+		info.DirectDistanceCodes = int(block_params.dist.num_direct_distance_codes)
+	}
+
 	if bytes+4 < *storage_ix>>3 {
 		/* Restore the distance cache and last byte. */
 		copy(dist_cache, saved_dist_cache[:4])
@@ -1002,6 +1116,15 @@ func writeMetaBlockInternal(data []byte, mask uint, last_flush_pos uint64, bytes
 		storage[1] = byte(last_bytes >> 8)
 		*storage_ix = uint(last_bytes_bits)
 		storeUncompressedMetaBlock(is_last, data, uint(wrapped_last_flush_pos), mask, bytes, storage_ix, storage)
+		mb_log.compressed--
+		mb_log.uncompressed++
+		if info != nil {
+			info.Uncompressed = true
+		}
+	}
+
+	if info != nil {
+		traceMetaBlockEnd(mb_log, *storage_ix)
 	}
 }
 
@@ -1069,6 +1192,7 @@ func encoderInitParams(params *encoderParams) {
 	params.lgwin = defaultWindow
 	params.lgblock = 0
 	params.size_hint = 0
+	params.stream_offset = 0
 	params.disable_literal_context_modeling = false
 	initEncoderDictionary(&params.dictionary)
 	params.dist.distance_postfix_bits = 0
@@ -1087,26 +1211,27 @@ func encoderInitState(s *Writer) {
 	s.last_processed_pos_ = 0
 	s.prev_byte_ = 0
 	s.prev_byte2_ = 0
-	s.storage_size_ = 0
-	s.storage_ = nil
-	s.hasher_ = nil
-	s.large_table_ = nil
-	s.large_table_size_ = 0
 	s.cmd_code_numbits_ = 0
-	s.command_buf_ = nil
-	s.literal_buf_ = nil
 	s.next_out_ = nil
 	s.available_out_ = 0
 	s.total_out_ = 0
+	s.bytes_in_ = 0
+	s.metablocks_.compressed = 0
+	s.metablocks_.uncompressed = 0
+	s.metablocks_.tracing = false
+	s.metablocks_.records = s.metablocks_.records[:0]
+	s.metablocks_.traced_pos = 0
+	s.flushes_ = 0
 	s.stream_state_ = streamProcessing
 	s.is_last_block_emitted_ = false
 	s.is_initialized_ = false
 
+	/* Buffers left over from a previous stream (storage_, large_table_,
+	   commands_, command_buf_, literal_buf_, the ring buffer and the hasher)
+	   are kept, so that a reset Writer does not have to allocate them again. */
+	hasherReset(s.hasher_)
 	ringBufferInit(&s.ringbuffer_)
 
-	s.commands_ = nil
-	s.cmd_alloc_size_ = 0
-
 	/* Initialize distance cache. */
 	s.dist_cache_[0] = 4
 
@@ -1127,8 +1252,26 @@ func encoderInitState(s *Writer) {
    copied to the ring buffer, otherwise the next WriteBrotliData() will fail.
 */
 func copyInputToRingBuffer(s *Writer, input_size uint, input_buffer []byte) {
+	ringBufferWrite(input_buffer, input_size, &s.ringbuffer_)
+	inputCopiedToRingBuffer(s, input_size)
+}
+
+/* Like copyInputToRingBuffer, but reads the input from |src| straight into
+   the ring buffer, up to the end of the current input block. Returns the
+   number of bytes read and the error from |src|. */
+func readInputToRingBuffer(s *Writer, src io.Reader) (uint, error) {
+	var space []byte = ringBufferWriteSpace(remainingInputBlockSize(s), &s.ringbuffer_)
+	n, err := src.Read(space)
+	if n > 0 {
+		ringBufferCommit(uint(n), &s.ringbuffer_)
+		inputCopiedToRingBuffer(s, uint(n))
+	}
+
+	return uint(n), err
+}
+
+func inputCopiedToRingBuffer(s *Writer, input_size uint) {
 	var ringbuffer_ *ringBuffer = &s.ringbuffer_
-	ringBufferWrite(input_buffer, input_size, ringbuffer_)
 	s.input_pos_ += uint64(input_size)
 
 	/* TL;DR: If needed, initialize 7 more bytes in the ring buffer to make the
@@ -1276,9 +1419,13 @@ func encodeData(s *Writer, is_last bool, force_flush bool, out_size *uint, outpu
 		storage[1] = byte(s.last_bytes_ >> 8)
 		table = getHashTable(s, s.params.quality, uint(bytes), &table_size)
 		if s.params.quality == fastOnePassCompressionQuality {
-			compressFragmentFast(data[wrapped_last_processed_pos&mask:], uint(bytes), is_last, table, table_size, s.cmd_depths_[:], s.cmd_bits_[:], &s.cmd_code_numbits_, s.cmd_code_[:], &storage_ix, storage)
+			compressFragmentFast(data[wrapped_last_processed_pos&mask:], uint(bytes), is_last, table, table_size, s.cmd_depths_[:], s.cmd_bits_[:], &s.cmd_code_numbits_, s.cmd_code_[:], &s.metablocks_, &storage_ix, storage)
 		} else {
-			compressFragmentTwoPass(data[wrapped_last_processed_pos&mask:], uint(bytes), is_last, s.command_buf_, s.literal_buf_, table, table_size, &storage_ix, storage)
+			compressFragmentTwoPass(data[wrapped_last_processed_pos&mask:], uint(bytes), is_last, s.command_buf_, s.literal_buf_, table, table_size, &s.metablocks_, &storage_ix, storage)
+		}
+
+		if s.metablocks_.tracing {
+			reportMetaBlocks(s)
 		}
 
 		s.last_bytes_ = uint16(storage[storage_ix>>3])
@@ -1374,7 +1521,11 @@ func encodeData(s *Writer, is_last bool, force_flush bool, out_size *uint, outpu
 		var storage_ix uint = uint(s.last_bytes_bits_)
 		storage[0] = byte(s.last_bytes_)
 		storage[1] = byte(s.last_bytes_ >> 8)
-		writeMetaBlockInternal(data, uint(mask), s.last_flush_pos_, uint(metablock_size), is_last, literal_context_mode, &s.params, s.prev_byte_, s.prev_byte2_, s.num_literals_, s.num_commands_, s.commands_, s.saved_dist_cache_[:], s.dist_cache_[:], &storage_ix, storage)
+		writeMetaBlockInternal(data, uint(mask), s.last_flush_pos_, uint(metablock_size), is_last, literal_context_mode, &s.params, s.prev_byte_, s.prev_byte2_, s.num_literals_, s.num_commands_, s.commands_, s.saved_dist_cache_[:], s.dist_cache_[:], &s.metablocks_, &storage_ix, storage)
+		if s.metablocks_.tracing {
+			reportMetaBlocks(s)
+		}
+
 		s.last_bytes_ = uint16(storage[storage_ix>>3])
 		s.last_bytes_bits_ = byte(storage_ix & 7)
 		s.last_flush_pos_ = s.input_pos_
@@ -1435,6 +1586,49 @@ func writeMetadataHeader(s *Writer, block_size uint, header []byte) uint {
 	return (storage_ix + 7) >> 3
 }
 
+/* Appends |input| to |dst| as a stream of uncompressed metablocks.
+   This is what the one-shot encoder falls back to when compression does not
+   pay off; its size is bounded by maxCompressedSize(len(input)). */
+func makeUncompressedStream(dst []byte, input []byte) []byte {
+	var size uint = uint(len(input))
+	var offset uint = 0
+	if size == 0 {
+		return append(dst, 6)
+	}
+
+	dst = append(dst, 0x21) /* window bits = 10, is_last = false */
+	dst = append(dst, 0x03) /* empty metadata, padding */
+	for size > 0 {
+		var nibbles uint32 = 0
+		var chunk_size uint32
+		var bits uint32
+		if size > 1<<24 {
+			chunk_size = 1 << 24
+		} else {
+			chunk_size = uint32(size)
+		}
+		if chunk_size > 1<<16 {
+			if chunk_size > 1<<20 {
+				nibbles = 2
+			} else {
+				nibbles = 1
+			}
+		}
+
+		bits = nibbles<<1 | (chunk_size-1)<<3 | 1<<(19+4*nibbles)
+		dst = append(dst, byte(bits), byte(bits>>8), byte(bits>>16))
+		if nibbles == 2 {
+			dst = append(dst, byte(bits>>24))
+		}
+
+		dst = append(dst, input[offset:offset+uint(chunk_size)]...)
+		offset += uint(chunk_size)
+		size -= uint(chunk_size)
+	}
+
+	return append(dst, 3)
+}
+
 func injectBytePaddingBlock(s *Writer) {
 	var seal uint32 = uint32(s.last_bytes_)
 	var seal_bits uint = uint(s.last_bytes_bits_)
@@ -1466,6 +1660,70 @@ func injectBytePaddingBlock(s *Writer) {
 	s.available_out_ += (seal_bits + 7) >> 3
 }
 
+/* Ends the stream with an empty last meta-block, writing the stream header
+   first if nothing else has. Used when the data meta-blocks were produced by
+   other encoders, which leave the output at a byte boundary (see
+   parallel.go). */
+func injectLastEmptyMetaBlock(s *Writer) {
+	var seal uint32 = uint32(s.last_bytes_)
+	var seal_bits uint = uint(s.last_bytes_bits_)
+	s.last_bytes_ = 0
+	s.last_bytes_bits_ = 0
+
+	/* is_last = 1, is_empty = 1 */
+	seal |= 0x3 << seal_bits
+
+	seal_bits += 2
+	s.next_out_ = s.tiny_buf_.u8[:]
+	s.next_out_[0] = byte(seal)
+	if seal_bits > 8 {
+		s.next_out_[1] = byte(seal >> 8)
+	}
+	s.available_out_ = (seal_bits + 7) >> 3
+	s.is_last_block_emitted_ = true
+	s.stream_state_ = streamFinished
+}
+
+/* Prepares a fresh encoder to compress data that comes |stream_offset| bytes
+   into a stream whose header and earlier meta-blocks are written by someone
+   else (see parallel.go). Nothing is written for the stream header, and the
+   data is compressed on its own: its backward references do not reach
+   before its start, except into the dictionaries. |prev| holds the (up to)
+   two bytes before the data, which give the context of its first literals.
+
+   The decoder's distance cache is not known, so it is poisoned: -16 +- 3 is
+   still less than zero (invalid), so short distance codes are only used for
+   distances the encoder has written itself. */
+func encoderContinueStream(s *Writer, stream_offset uint64, prev []byte) bool {
+	if !ensureInitialized(s) {
+		return false
+	}
+
+	s.last_bytes_ = 0
+	s.last_bytes_bits_ = 0
+	if stream_offset == 0 {
+		return true
+	}
+
+	if stream_offset > uint64(maxBackwardLimit(s.params.lgwin)) {
+		stream_offset = uint64(maxBackwardLimit(s.params.lgwin))
+	}
+	s.params.stream_offset = uint(stream_offset)
+	if len(prev) > 0 {
+		s.prev_byte_ = prev[len(prev)-1]
+	}
+	if len(prev) > 1 {
+		s.prev_byte2_ = prev[len(prev)-2]
+	}
+
+	s.dist_cache_[0] = -16
+	s.dist_cache_[1] = -16
+	s.dist_cache_[2] = -16
+	s.dist_cache_[3] = -16
+	copy(s.saved_dist_cache_[:], s.dist_cache_[:])
+	return true
+}
+
 func checkFlushComplete(s *Writer) {
 	if s.stream_state_ == streamFlushRequested && s.available_out_ == 0 {
 		s.stream_state_ = streamProcessing
@@ -1532,9 +1790,13 @@ func encoderCompressStreamFast(s *Writer, op int, available_in *uint, next_in *[
 			table = getHashTable(s, s.params.quality, block_size, &table_size)
 
 			if s.params.quality == fastOnePassCompressionQuality {
-				compressFragmentFast(*next_in, block_size, is_last, table, table_size, s.cmd_depths_[:], s.cmd_bits_[:], &s.cmd_code_numbits_, s.cmd_code_[:], &storage_ix, storage)
+				compressFragmentFast(*next_in, block_size, is_last, table, table_size, s.cmd_depths_[:], s.cmd_bits_[:], &s.cmd_code_numbits_, s.cmd_code_[:], &s.metablocks_, &storage_ix, storage)
 			} else {
-				compressFragmentTwoPass(*next_in, block_size, is_last, command_buf, literal_buf, table, table_size, &storage_ix, storage)
+				compressFragmentTwoPass(*next_in, block_size, is_last, command_buf, literal_buf, table, table_size, &s.metablocks_, &storage_ix, storage)
+			}
+
+			if s.metablocks_.tracing {
+				reportMetaBlocks(s)
 			}
 
 			*next_in = (*next_in)[block_size:]
@@ -1608,13 +1870,17 @@ func processMetadata(s *Writer, available_in *uint, next_in *[]byte) bool {
 			if s.remaining_metadata_bytes_ == 0 {
 				s.remaining_metadata_bytes_ = math.MaxUint32
 				s.stream_state_ = streamProcessing
+
+				/* Don't let a later padding block write into the caller's input. */
+				s.next_out_ = nil
 				break
 			}
 
-			/* This guarantees progress in "TakeOutput" workflow. */
-			var c uint32 = brotli_min_uint32_t(s.remaining_metadata_bytes_, 16)
-			s.next_out_ = s.tiny_buf_.u8[:]
-			copy(s.next_out_, (*next_in)[:c])
+			/* Writer takes the output before the caller can modify the input, so
+			   the payload is handed out as is instead of being copied through
+			   tiny_buf_ 16 bytes at a time. */
+			var c uint32 = brotli_min_uint32_t(s.remaining_metadata_bytes_, uint32(*available_in))
+			s.next_out_ = (*next_in)[:c]
 			*next_in = (*next_in)[c:]
 			*available_in -= uint(c)
 			s.remaining_metadata_bytes_ -= c
@@ -8,6 +8,9 @@ type encoderDictionary struct {
 	hash_table            []uint16
 	buckets               []uint16
 	dict_words            []dictWord
+
+	/* Custom prefix dictionary; empty unless WriterOptions.Dictionary is set. */
+	compound preparedDictionary
 }
 
 func initEncoderDictionary(dict *encoderDictionary) {
@@ -158,8 +158,8 @@ func storeAndFindMatchesH10(self *h10, data []byte, cur_ix uint, ring_buffer_mas
    Sets *num_matches to the number of matches found, and stores the found
    matches in matches[0] to matches[*num_matches - 1]. The matches will be
    sorted by strictly increasing length and (non-strictly) increasing
-   distance. */
-func findAllMatchesH10(handle *h10, dictionary *encoderDictionary, data []byte, ring_buffer_mask uint, cur_ix uint, max_length uint, max_backward uint, gap uint, params *encoderParams, matches []backwardMatch) uint {
+   distance. Dictionary distances start past |dictionary_start| + |gap|. */
+func findAllMatchesH10(handle *h10, dictionary *encoderDictionary, data []byte, ring_buffer_mask uint, cur_ix uint, max_length uint, max_backward uint, dictionary_start uint, gap uint, params *encoderParams, matches []backwardMatch) uint {
 	var orig_matches []backwardMatch = matches
 	var cur_ix_masked uint = cur_ix & ring_buffer_mask
 	var best_len uint = 1
@@ -200,6 +200,10 @@ func findAllMatchesH10(handle *h10, dictionary *encoderDictionary, data []byte,
 		matches = storeAndFindMatchesH10(handle, data, cur_ix, ring_buffer_mask, max_length, max_backward, &best_len, matches)
 	}
 
+	if gap != 0 && best_len < max_length {
+		matches = findAllCompoundDictionaryMatches(&dictionary.compound, data, ring_buffer_mask, cur_ix, max_length, dictionary_start, params.dist.max_distance, &best_len, matches)
+	}
+
 	for i = 0; i <= maxStaticDictionaryMatchLen; i++ {
 		dict_matches[i] = kInvalidMatch
 	}
@@ -211,7 +215,7 @@ func findAllMatchesH10(handle *h10, dictionary *encoderDictionary, data []byte,
 			for l = minlen; l <= maxlen; l++ {
 				var dict_id uint32 = dict_matches[l]
 				if dict_id < kInvalidMatch {
-					var distance uint = max_backward + gap + uint(dict_id>>5) + 1
+					var distance uint = dictionary_start + gap + uint(dict_id>>5) + 1
 					if distance <= params.dist.max_distance {
 						initDictionaryBackwardMatch(&matches[0], distance, l, uint(dict_id&31))
 						matches = matches[1:]
@@ -278,7 +282,7 @@ func (h *h10) StitchToPreviousBlock(num_bytes uint, position uint, ringbuffer []
 /* MAX_NUM_MATCHES == 64 + MAX_TREE_SEARCH_DEPTH */
 const maxNumMatchesH10 = 128
 
-func (*h10) FindLongestMatch(dictionary *encoderDictionary, data []byte, ring_buffer_mask uint, distance_cache []int, cur_ix uint, max_length uint, max_backward uint, gap uint, max_distance uint, out *hasherSearchResult) {
+func (*h10) FindLongestMatch(dictionary *encoderDictionary, data []byte, ring_buffer_mask uint, distance_cache []int, cur_ix uint, max_length uint, max_backward uint, dictionary_distance uint, max_distance uint, out *hasherSearchResult) {
 	panic("unimplemented")
 }
 
@@ -111,7 +111,7 @@ func (h *h5) PrepareDistanceCache(distance_cache []int) {
    Does not look for matches further away than max_backward.
    Writes the best match into |out|.
    |out|->score is updated only if a better match is found. */
-func (h *h5) FindLongestMatch(dictionary *encoderDictionary, data []byte, ring_buffer_mask uint, distance_cache []int, cur_ix uint, max_length uint, max_backward uint, gap uint, max_distance uint, out *hasherSearchResult) {
+func (h *h5) FindLongestMatch(dictionary *encoderDictionary, data []byte, ring_buffer_mask uint, distance_cache []int, cur_ix uint, max_length uint, max_backward uint, dictionary_distance uint, max_distance uint, out *hasherSearchResult) {
 	var num []uint16 = h.num
 	var buckets []uint32 = h.buckets
 	var cur_ix_masked uint = cur_ix & ring_buffer_mask
@@ -209,6 +209,6 @@ func (h *h5) FindLongestMatch(dictionary *encoderDictionary, data []byte, ring_b
 	}
 
 	if min_score == out.score {
-		searchInStaticDictionary(dictionary, h, data[cur_ix_masked:], max_length, max_backward+gap, max_distance, out, false)
+		searchInStaticDictionary(dictionary, h, data[cur_ix_masked:], max_length, dictionary_distance, max_distance, out, false)
 	}
 }
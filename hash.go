@@ -24,7 +24,7 @@ type hasherHandle interface {
 	HashTypeLength() uint
 	StoreLookahead() uint
 	PrepareDistanceCache(distance_cache []int)
-	FindLongestMatch(dictionary *encoderDictionary, data []byte, ring_buffer_mask uint, distance_cache []int, cur_ix uint, max_length uint, max_backward uint, gap uint, max_distance uint, out *hasherSearchResult)
+	FindLongestMatch(dictionary *encoderDictionary, data []byte, ring_buffer_mask uint, distance_cache []int, cur_ix uint, max_length uint, max_backward uint, dictionary_distance uint, max_distance uint, out *hasherSearchResult)
 	StoreRange(data []byte, mask uint, ix_start uint, ix_end uint)
 	Store(data []byte, mask uint, ix uint)
 }
@@ -312,6 +312,23 @@ func hasherSetup(handle *hasherHandle, params *encoderParams, data []byte, posit
 	var self hasherHandle = nil
 	var common *hasherCommon = nil
 	var one_shot bool = (position == 0 && is_last)
+	if *handle != nil && !(*handle).Common().is_prepared_ {
+		/* The hasher is left over from a previous stream (see Writer.Reset),
+		   which the new one may take up at a later position (see
+		   encoderContinueStream). It can be reused only if the new stream
+		   needs the same kind. The composite hashers used for large windows
+		   are never reused, because only Initialize clears their rolling
+		   hash table. */
+		var hparams hasherParams
+		chooseHasher(params, &hparams)
+		_, is_composite := (*handle).(*hashComposite)
+		if hparams == (*handle).Common().params && !is_composite {
+			params.hasher = hparams
+		} else {
+			*handle = nil
+		}
+	}
+
 	if *handle == nil {
 		chooseHasher(params, &params.hasher)
 		self = newHasher(params.hasher.type_)
@@ -326,11 +343,8 @@ func hasherSetup(handle *hasherHandle, params *encoderParams, data []byte, posit
 	common = self.Common()
 	if !common.is_prepared_ {
 		self.Prepare(one_shot, input_size, data)
-
-		if position == 0 {
-			common.dict_num_lookups = 0
-			common.dict_num_matches = 0
-		}
+		common.dict_num_lookups = 0
+		common.dict_num_matches = 0
 
 		common.is_prepared_ = true
 	}
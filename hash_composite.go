@@ -36,33 +36,29 @@ type hashComposite struct {
 }
 
 func (h *hashComposite) Initialize(params *encoderParams) {
+	var common_a *hasherCommon
+	var common_b *hasherCommon
 	h.params = params
-}
-
-/* TODO: Initialize of the hashers is defered to Prepare (and params
-   remembered here) because we don't get the one_shot and input_size params
-   here that are needed to know the memory size of them. Instead provide
-   those params to all hashers InitializehashComposite */
-func (h *hashComposite) Prepare(one_shot bool, input_size uint, data []byte) {
-	if h.ha == nil {
-		var common_a *hasherCommon
-		var common_b *hasherCommon
 
-		common_a = h.ha.Common()
-		common_a.params = h.params.hasher
-		common_a.is_prepared_ = false
-		common_a.dict_num_lookups = 0
-		common_a.dict_num_matches = 0
-		h.ha.Initialize(h.params)
+	/* The C implementation defers this to Prepare, because only there it knows
+	   how much memory the sub-hashers need. Both sub-hashers are created by
+	   newHasher here, so they can be initialized right away. */
+	common_a = h.ha.Common()
+	common_a.params = h.params.hasher
+	common_a.is_prepared_ = false
+	common_a.dict_num_lookups = 0
+	common_a.dict_num_matches = 0
+	h.ha.Initialize(h.params)
 
-		common_b = h.hb.Common()
-		common_b.params = h.params.hasher
-		common_b.is_prepared_ = false
-		common_b.dict_num_lookups = 0
-		common_b.dict_num_matches = 0
-		h.hb.Initialize(h.params)
-	}
+	common_b = h.hb.Common()
+	common_b.params = h.params.hasher
+	common_b.is_prepared_ = false
+	common_b.dict_num_lookups = 0
+	common_b.dict_num_matches = 0
+	h.hb.Initialize(h.params)
+}
 
+func (h *hashComposite) Prepare(one_shot bool, input_size uint, data []byte) {
 	h.ha.Prepare(one_shot, input_size, data)
 	h.hb.Prepare(one_shot, input_size, data)
 }
@@ -87,7 +83,7 @@ func (h *hashComposite) PrepareDistanceCache(distance_cache []int) {
 	h.hb.PrepareDistanceCache(distance_cache)
 }
 
-func (h *hashComposite) FindLongestMatch(dictionary *encoderDictionary, data []byte, ring_buffer_mask uint, distance_cache []int, cur_ix uint, max_length uint, max_backward uint, gap uint, max_distance uint, out *hasherSearchResult) {
-	h.ha.FindLongestMatch(dictionary, data, ring_buffer_mask, distance_cache, cur_ix, max_length, max_backward, gap, max_distance, out)
-	h.hb.FindLongestMatch(dictionary, data, ring_buffer_mask, distance_cache, cur_ix, max_length, max_backward, gap, max_distance, out)
+func (h *hashComposite) FindLongestMatch(dictionary *encoderDictionary, data []byte, ring_buffer_mask uint, distance_cache []int, cur_ix uint, max_length uint, max_backward uint, dictionary_distance uint, max_distance uint, out *hasherSearchResult) {
+	h.ha.FindLongestMatch(dictionary, data, ring_buffer_mask, distance_cache, cur_ix, max_length, max_backward, dictionary_distance, max_distance, out)
+	h.hb.FindLongestMatch(dictionary, data, ring_buffer_mask, distance_cache, cur_ix, max_length, max_backward, dictionary_distance, max_distance, out)
 }
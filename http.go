@@ -0,0 +1,563 @@
+package brotli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CompressHandlerOptions configures CompressHandler.
+type CompressHandlerOptions struct {
+	// MinSize is the size of the smallest body worth compressing. Smaller
+	// ones are sent as they are, since compression gains little on them.
+	// Responses that are flushed before MinSize bytes are written, such as
+	// streams of events, are compressed anyway unless their Content-Length
+	// is below MinSize. 0 means 1024.
+	MinSize int
+	// Quality returns the compression quality for responses of the given
+	// media type, such as "text/html", in lower case and without
+	// parameters; it is "" for responses that are flushed before their type
+	// is known. A negative quality leaves the responses uncompressed. If
+	// Quality is nil, DefaultResponseQuality is used.
+	Quality func(mediaType string) int
+	// LGWin is the window size of the Writers, as in WriterOptions. Each
+	// response being compressed holds a Writer, whose memory grows with the
+	// window. 0 chooses it from the quality.
+	LGWin int
+}
+
+// CompressHandler returns a handler that calls h and compresses its
+// responses with Brotli for the clients that accept it, as told by the
+// q-values of their Accept-Encoding header. It leaves alone the responses
+// that have no body, such as those to HEAD requests and 304 responses, as
+// well as partial content, bodies smaller than options.MinSize, media types
+// for which options.Quality is negative, and responses that already have a
+// Content-Encoding or whose Cache-Control forbids transforming them.
+//
+// For compressed responses, it sets Content-Encoding, removes
+// Content-Length and Accept-Ranges, and appends "-br" to the ETag, so that
+// caches tell the two representations apart; a conditional request for the
+// compressed representation is passed to h with the suffix removed. It adds
+// "Accept-Encoding" to the Vary header of every response whose compression
+// depends on the client. Flushing the http.ResponseWriter passed to h, with
+// http.Flusher or http.ResponseController, flushes the compressed stream.
+// Writers are reused between responses.
+func CompressHandler(h http.Handler, options CompressHandlerOptions) http.Handler {
+	if options.MinSize == 0 {
+		options.MinSize = 1024
+	}
+	if options.Quality == nil {
+		options.Quality = DefaultResponseQuality
+	}
+	return &compressHandler{h: h, options: options}
+}
+
+type compressHandler struct {
+	h       http.Handler
+	options CompressHandlerOptions
+	pools   [12]sync.Pool // idle Writers, by quality
+}
+
+// DefaultResponseQuality is the default CompressHandlerOptions.Quality. It
+// returns -1 for media types that are compressed already, such as most
+// images, audio, video, fonts and archives, and 5 for the others.
+func DefaultResponseQuality(mediaType string) int {
+	switch mediaType {
+	case "image/svg+xml", "image/bmp", "image/x-icon", "image/vnd.microsoft.icon", "audio/wav", "audio/x-wav":
+		return 5
+	case "application/zip", "application/gzip", "application/x-gzip", "application/x-bzip2",
+		"application/x-xz", "application/zstd", "application/x-7z-compressed",
+		"application/x-rar-compressed", "application/vnd.rar", "application/x-brotli",
+		"font/woff", "font/woff2", "application/font-woff":
+		return -1
+	}
+	if strings.HasPrefix(mediaType, "image/") || strings.HasPrefix(mediaType, "audio/") || strings.HasPrefix(mediaType, "video/") {
+		return -1
+	}
+	return 5
+}
+
+func (h *compressHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cw := &compressResponseWriter{
+		ResponseWriter: w,
+		h:              h,
+		accept:         acceptEncodingQuality(r.Header["Accept-Encoding"], "br") > 0,
+		head:           r.Method == http.MethodHead,
+	}
+	if cw.accept {
+		r, cw.strippedETag = stripETagSuffix(r)
+	}
+	defer cw.close()
+	h.h.ServeHTTP(cw, r)
+}
+
+// getWriter returns a Writer at the given quality, writing to dst.
+func (h *compressHandler) getWriter(dst *compressResponseWriter, quality int) *Writer {
+	if v := h.pools[quality].Get(); v != nil {
+		bw := v.(*Writer)
+		bw.Reset(dst.ResponseWriter)
+		return bw
+	}
+	return NewWriter(dst.ResponseWriter, WriterOptions{Quality: quality, LGWin: h.options.LGWin})
+}
+
+// compressResponseWriter buffers the start of the body until it can decide
+// whether to compress the response.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	h            *compressHandler
+	accept       bool // the client accepts Brotli
+	head         bool
+	strippedETag bool // the request's ETags had the "-br" suffix removed
+
+	status  int     // status passed to WriteHeader, 0 if none
+	started bool    // headers have been sent
+	buf     []byte  // body written before the headers were sent
+	bw      *Writer // set while compressing
+	quality int
+}
+
+func (w *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *compressResponseWriter) WriteHeader(code int) {
+	if w.started || w.status != 0 {
+		return
+	}
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		// Informational responses are sent right away.
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.status = code
+	if !bodyAllowed(code) || w.head {
+		w.start(true)
+	}
+}
+
+func (w *compressResponseWriter) Write(p []byte) (int, error) {
+	if !w.started {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		w.buf = append(w.buf, p...)
+		if len(w.buf) < w.h.options.MinSize {
+			return len(p), nil
+		}
+		if err := w.start(false); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if w.bw != nil {
+		return w.bw.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher.
+func (w *compressResponseWriter) Flush() {
+	if !w.started {
+		if w.start(false) != nil {
+			return
+		}
+	}
+	if w.bw != nil {
+		if w.bw.Flush() != nil {
+			return
+		}
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close finishes the response once the handler has returned.
+func (w *compressResponseWriter) close() {
+	if !w.started {
+		if w.status == 0 && len(w.buf) == 0 {
+			// Let net/http send its default response.
+			w.started = true
+			return
+		}
+		// If writing the buffered body fails, the Writer still has to be
+		// closed and given back.
+		w.start(true)
+	}
+	if w.bw != nil {
+		w.bw.Close()
+		w.h.pools[w.quality].Put(w.bw)
+		w.bw = nil
+	}
+}
+
+// start decides whether to compress the response, sends the headers and
+// writes the buffered part of the body. ended reports that the handler has
+// written the whole body.
+func (w *compressResponseWriter) start(ended bool) error {
+	w.started = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	hdr := w.Header()
+	if w.compress(ended) {
+		hdr.Del("Content-Length")
+		hdr.Del("Accept-Ranges")
+		hdr.Set("Content-Encoding", "br")
+		if etag := hdr.Get("Etag"); etag != "" {
+			hdr.Set("Etag", addETagSuffix(etag))
+		}
+		w.bw = w.h.getWriter(w, w.quality)
+	} else if w.status == http.StatusNotModified && w.strippedETag {
+		// The client has the compressed representation.
+		addVary(hdr)
+		if etag := hdr.Get("Etag"); etag != "" {
+			hdr.Set("Etag", addETagSuffix(etag))
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.bw != nil {
+		_, err = w.bw.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// compress reports whether to compress the response, and sets w.quality.
+// It also adds Accept-Encoding to the Vary header if the answer depends on
+// it.
+func (w *compressResponseWriter) compress(ended bool) bool {
+	hdr := w.Header()
+	if w.head || !bodyAllowed(w.status) || w.status == http.StatusPartialContent {
+		return false
+	}
+	if hdr.Get("Content-Encoding") != "" || strings.Contains(strings.ToLower(hdr.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+	if ended && len(w.buf) < w.h.options.MinSize {
+		return false
+	}
+	if cl, err := strconv.ParseInt(hdr.Get("Content-Length"), 10, 64); err == nil && cl < int64(w.h.options.MinSize) {
+		return false
+	}
+
+	if _, ok := hdr["Content-Type"]; !ok && len(w.buf) > 0 {
+		// net/http would sniff the compressed data otherwise.
+		hdr.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+	mediaType := hdr.Get("Content-Type")
+	if i := strings.IndexByte(mediaType, ';'); i >= 0 {
+		mediaType = mediaType[:i]
+	}
+	quality := w.h.options.Quality(strings.ToLower(strings.TrimSpace(mediaType)))
+	if quality < 0 {
+		return false
+	}
+
+	addVary(hdr)
+	if !w.accept {
+		return false
+	}
+	if quality > 11 {
+		quality = 11
+	}
+	w.quality = quality
+	return true
+}
+
+// bodyAllowed reports whether a response with the given status can have a
+// body.
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// addVary adds Accept-Encoding to the Vary header, unless it is there
+// already.
+func addVary(hdr http.Header) {
+	for _, v := range hdr.Values("Vary") {
+		for _, field := range strings.Split(v, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, "Accept-Encoding") {
+				return
+			}
+		}
+	}
+	hdr.Add("Vary", "Accept-Encoding")
+}
+
+// addETagSuffix appends "-br" to the opaque part of an entity tag.
+func addETagSuffix(etag string) string {
+	if len(etag) < 2 || etag[len(etag)-1] != '"' {
+		return etag
+	}
+	return etag[:len(etag)-1] + `-br"`
+}
+
+// stripETagSuffix returns r, or a copy of it whose If-None-Match and
+// If-Match headers have the "-br" suffix removed from their entity tags, so
+// that the handler recognizes them. It reports whether there was a suffix.
+func stripETagSuffix(r *http.Request) (*http.Request, bool) {
+	stripped := false
+	var hdr http.Header
+	for _, name := range []string{"If-None-Match", "If-Match"} {
+		v := r.Header.Get(name)
+		if !strings.Contains(v, `-br"`) {
+			continue
+		}
+		if hdr == nil {
+			hdr = r.Header.Clone()
+		}
+		hdr.Set(name, strings.Replace(v, `-br"`, `"`, -1))
+		stripped = true
+	}
+	if !stripped {
+		return r, false
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Header = hdr
+	return r2, true
+}
+
+// acceptEncodingQuality returns the q-value that the Accept-Encoding header
+// values give to coding, or 0 if they do not accept it.
+func acceptEncodingQuality(values []string, coding string) float64 {
+	q, wildcard := -1.0, -1.0
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			params := strings.Split(item, ";")
+			name := strings.ToLower(strings.TrimSpace(params[0]))
+			if name == "" {
+				continue
+			}
+			itemQ := 1.0
+			for _, p := range params[1:] {
+				p = strings.TrimSpace(p)
+				if len(p) < 2 || (p[0] != 'q' && p[0] != 'Q') || p[1] != '=' {
+					continue
+				}
+				f, err := strconv.ParseFloat(strings.TrimSpace(p[2:]), 64)
+				if err != nil || f < 0 || f > 1 {
+					f = 0
+				}
+				itemQ = f
+			}
+			switch name {
+			case coding:
+				if itemQ > q {
+					q = itemQ
+				}
+			case "*":
+				if itemQ > wildcard {
+					wildcard = itemQ
+				}
+			}
+		}
+	}
+	if q >= 0 {
+		return q
+	}
+	if wildcard > 0 {
+		return wildcard
+	}
+	return 0
+}
+
+// errRatioLimit is returned by request bodies whose compression ratio
+// exceeds DecompressRequestOptions.MaxRatio.
+var errRatioLimit = fmt.Errorf("%w: compression ratio exceeds MaxRatio", ErrOutputLimit)
+
+// minRatioCheckSize is the amount of decompressed data below which
+// DecompressRequestOptions.MaxRatio is not checked, since small inputs can
+// have high ratios legitimately.
+const minRatioCheckSize = 64 << 10
+
+// DecompressRequestOptions configures DecompressRequestHandler.
+type DecompressRequestOptions struct {
+	// ReaderOptions configures the decoding of request bodies. Its
+	// MaxDecodedSize caps the size of a decompressed body, and its
+	// MemoryLimit or MaxWindowBits the memory of each decoder.
+	ReaderOptions ReaderOptions
+	// MaxRatio, if positive, is the highest compression ratio accepted, as
+	// decompressed bytes per compressed byte, against zip bomb style
+	// inputs. It is checked as the body is read, once it has produced
+	// 64 KiB. Ordinary text rarely compresses more than 20 times.
+	MaxRatio float64
+}
+
+// DecompressRequestHandler returns a handler that decodes the bodies of the
+// requests sent with "Content-Encoding: br", and calls h with r.Body
+// replaced by the decompressed data. The Content-Encoding and
+// Content-Length headers are removed and r.ContentLength is set to -1, as
+// the decompressed size is not known in advance. Other requests are passed
+// to h as they are.
+//
+// Reading the body fails if it is corrupt, or if it exceeds the limits of
+// options. If that happens before h has started its response, the handler
+// responds with 413 Request Entity Too Large for bodies that exceed a limit
+// and 400 Bad Request for invalid ones, and drops the response of h.
+// During the call to h, RequestBodyStats tells how much of the body has been
+// read.
+func DecompressRequestHandler(h http.Handler, options DecompressRequestOptions) http.Handler {
+	return &decompressRequestHandler{h: h, options: options}
+}
+
+type decompressRequestHandler struct {
+	h       http.Handler
+	options DecompressRequestOptions
+	readers sync.Pool // idle Readers
+}
+
+// requestBodyKey is the context key of the requestBody of a request.
+type requestBodyKey struct{}
+
+// RequestBodyStats returns the statistics of the Reader decoding the body of
+// a request passed to the handler of DecompressRequestHandler: BytesIn is
+// the number of compressed bytes read so far, and BytesOut the number of
+// decompressed ones. ok is false for requests whose body is not decoded.
+func RequestBodyStats(r *http.Request) (stats ReaderStats, ok bool) {
+	b, ok := r.Context().Value(requestBodyKey{}).(*requestBody)
+	if !ok {
+		return ReaderStats{}, false
+	}
+	return b.r.Stats(), true
+}
+
+func (h *decompressRequestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.EqualFold(strings.TrimSpace(r.Header.Get("Content-Encoding")), "br") {
+		h.h.ServeHTTP(w, r)
+		return
+	}
+
+	b := &requestBody{body: r.Body, maxRatio: h.options.MaxRatio}
+	if v := h.readers.Get(); v != nil {
+		b.r = v.(*Reader)
+		b.r.Reset(r.Body)
+	} else {
+		b.r = NewReaderOptions(r.Body, h.options.ReaderOptions)
+	}
+	r = r.WithContext(context.WithValue(r.Context(), requestBodyKey{}, b))
+	r.Body = b
+	r.ContentLength = -1
+	r.Header = r.Header.Clone()
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+
+	dw := &decompressResponseWriter{ResponseWriter: w, body: b}
+	h.h.ServeHTTP(dw, r)
+	dw.reject()
+
+	b.r.Reset(nil)
+	h.readers.Put(b.r)
+}
+
+// requestBody is the decompressed body of a request.
+type requestBody struct {
+	body     io.ReadCloser
+	r        *Reader
+	maxRatio float64
+	err      error // the error that reading the body failed with
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.r.Read(p)
+	if err == nil && b.maxRatio > 0 {
+		stats := b.r.Stats()
+		if stats.BytesOut > minRatioCheckSize && float64(stats.BytesOut) > b.maxRatio*float64(stats.BytesIn) {
+			err = errRatioLimit
+		}
+	}
+	if err != nil {
+		b.err = err
+	}
+	return n, err
+}
+
+func (b *requestBody) Close() error {
+	return b.body.Close()
+}
+
+// failed reports whether reading the body has failed, as opposed to ended.
+func (b *requestBody) failed() bool {
+	return b.err != nil && b.err != io.EOF
+}
+
+// decompressResponseWriter replaces the response of a handler with an error
+// response if reading the request body fails before the handler has
+// started its own.
+type decompressResponseWriter struct {
+	http.ResponseWriter
+	body     *requestBody
+	started  bool
+	rejected bool
+}
+
+func (w *decompressResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// reject sends the error response if the request body has failed and the
+// handler has not started its response, and reports whether the response
+// of the handler is to be dropped.
+func (w *decompressResponseWriter) reject() bool {
+	if w.rejected {
+		return true
+	}
+	if w.started || !w.body.failed() {
+		return false
+	}
+	w.rejected = true
+	status := http.StatusBadRequest
+	var maxBytesErr *http.MaxBytesError
+	if errors.Is(w.body.err, ErrOutputLimit) || errors.Is(w.body.err, ErrMemoryLimit) || errors.As(w.body.err, &maxBytesErr) {
+		status = http.StatusRequestEntityTooLarge
+	}
+	http.Error(w.ResponseWriter, w.body.err.Error(), status)
+	return true
+}
+
+func (w *decompressResponseWriter) WriteHeader(code int) {
+	if w.reject() {
+		return
+	}
+	if code >= 200 || code == http.StatusSwitchingProtocols {
+		w.started = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *decompressResponseWriter) Write(p []byte) (int, error) {
+	if w.reject() {
+		return len(p), nil
+	}
+	w.started = true
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher.
+func (w *decompressResponseWriter) Flush() {
+	if w.reject() {
+		return
+	}
+	w.started = true
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,330 @@
+package brotli
+
+import (
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+// StreamStructure describes how a stream is encoded, as reported by Inspect.
+type StreamStructure struct {
+	// WindowBits is the base 2 logarithm of the sliding window size
+	// declared by the stream header, and LargeWindow reports that the
+	// header uses the "Large Window Brotli" extension.
+	WindowBits  int
+	LargeWindow bool
+	// CompressedSize and DecodedSize are the sizes of the part of the
+	// stream that has been decoded.
+	CompressedSize int64
+	DecodedSize    int64
+	// Metablocks lists the metablocks in stream order. If the stream is
+	// invalid, the last one is where decoding failed.
+	Metablocks []MetablockStructure
+}
+
+// MetablockStructure describes the header of a metablock, in the terms of
+// RFC 7932.
+type MetablockStructure struct {
+	// BitOffset is the position of the metablock header in the stream, in
+	// bits, and OutputOffset the number of decompressed bytes before the
+	// metablock.
+	BitOffset    int64
+	OutputOffset int64
+	// Length is MLEN, the number of decompressed bytes in the metablock, or
+	// the size of the payload of a metadata block.
+	Length int
+	// IsLast, IsUncompressed and IsMetadata are the ISLAST and
+	// ISUNCOMPRESSED flags, and whether the metablock is a metadata block.
+	IsLast         bool
+	IsUncompressed bool
+	IsMetadata     bool
+
+	// The rest is only set for compressed metablocks.
+
+	// DistancePostfixBits and DirectDistanceCodes are NPOSTFIX and NDIRECT.
+	DistancePostfixBits int
+	DirectDistanceCodes int
+	// ContextModes holds the context mode of each literal block type.
+	ContextModes []ContextMode
+	// Literals, Commands and Distances describe how literals,
+	// insert-and-copy lengths and distances are coded.
+	Literals  CategoryStructure
+	Commands  CategoryStructure
+	Distances CategoryStructure
+}
+
+// CategoryStructure describes how one category of symbols is coded in a
+// metablock.
+type CategoryStructure struct {
+	// BlockTypes is NBLTYPES, the number of block types.
+	BlockTypes int
+	// BlockTypeCode and BlockCountCode are the prefix codes of the block
+	// types and block counts, if there is more than one block type.
+	BlockTypeCode  *PrefixCode
+	BlockCountCode *PrefixCode
+	// Blocks lists the blocks in the order they are switched to, if there
+	// is more than one block type. Length counts symbols of the category,
+	// not bytes.
+	Blocks []Block
+	// Trees is NTREES, the number of prefix codes. Commands have one per
+	// block type.
+	Trees int
+	// ContextMap gives the index in Codes of the prefix code for each
+	// context of each block type. It is nil for commands, which have no
+	// context.
+	ContextMap []int
+	// Codes holds the prefix codes.
+	Codes []PrefixCode
+}
+
+// Block is a block of symbols of one category that share a block type.
+type Block struct {
+	Type   int
+	Length int
+}
+
+// PrefixCode describes a prefix code by the code lengths of its symbols.
+type PrefixCode struct {
+	// AlphabetSize is the number of symbols in the alphabet.
+	AlphabetSize int
+	// Simple reports that the code is given by a list of one to four
+	// symbols rather than by code lengths.
+	Simple bool
+	// Symbols lists the symbols that have a code, in increasing order, and
+	// Lengths their code lengths. A code with a single symbol has length 0.
+	Symbols []int
+	Lengths []int
+}
+
+func (c *PrefixCode) Len() int           { return len(c.Symbols) }
+func (c *PrefixCode) Less(i, j int) bool { return c.Symbols[i] < c.Symbols[j] }
+func (c *PrefixCode) Swap(i, j int) {
+	c.Symbols[i], c.Symbols[j] = c.Symbols[j], c.Symbols[i]
+	c.Lengths[i], c.Lengths[j] = c.Lengths[j], c.Lengths[i]
+}
+
+// inspector collects the structure of a stream as the decoder reads it.
+type inspector struct {
+	stream *StreamStructure
+}
+
+// Inspect decodes the stream read from src, throwing the output away, and
+// reports how it is encoded. If the stream is invalid, it returns the
+// structure decoded up to the failure along with the error. The whole
+// input is read into memory first. Of the options, MaxDecodedSize is
+// ignored.
+func Inspect(src io.Reader, options ReaderOptions) (*StreamStructure, error) {
+	input, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+
+	options.MaxDecodedSize = 0
+	r := &Reader{options: options}
+	r.initDecoder()
+	stream := new(StreamStructure)
+	r.inspector = &inspector{stream: stream}
+
+	availableIn := uint(len(input))
+	nextIn := input
+	for {
+		var availableOut uint
+		inLen := availableIn
+		result := decoderDecompressStream(r, &availableIn, &nextIn, &availableOut, nil)
+		r.total_in += uint64(inLen - availableIn)
+		for {
+			var size uint
+			if decoderTakeOutput(r, &size); size == 0 {
+				break
+			}
+		}
+		stream.CompressedSize = int64(r.total_in)
+		stream.DecodedSize = int64(r.partial_pos_out)
+
+		switch result {
+		case decoderResultSuccess:
+			if availableIn > 0 {
+				return stream, errExcessiveInput
+			}
+			return stream, nil
+		case decoderResultError:
+			return stream, r.decodeErr()
+		case decoderResultNeedsMoreInput:
+			return stream, io.ErrUnexpectedEOF
+		}
+	}
+}
+
+/* Returns the position of the bit reader in the stream, in bits. It is only
+   valid while the whole input is passed at once, as Inspect does. */
+func inspectBitPosition(s *Reader) int64 {
+	return int64((s.total_in+uint64(s.br.byte_pos))*8) - int64(getAvailableBits(&s.br))
+}
+
+/* Returns the metablock being decoded. */
+func (in *inspector) metablock() *MetablockStructure {
+	return &in.stream.Metablocks[len(in.stream.Metablocks)-1]
+}
+
+/* Returns the category of the block switch or tree group being decoded. */
+func (mb *MetablockStructure) category(tree_type int) *CategoryStructure {
+	switch tree_type {
+	case 0:
+		return &mb.Literals
+	case 1:
+		return &mb.Commands
+	}
+	return &mb.Distances
+}
+
+func inspectMetablockBegin(s *Reader) {
+	var stream *StreamStructure = s.inspector.stream
+	stream.WindowBits = int(s.window_bits)
+	stream.LargeWindow = s.large_window
+	stream.Metablocks = append(stream.Metablocks, MetablockStructure{
+		BitOffset:    inspectBitPosition(s),
+		OutputOffset: int64(s.partial_pos_out),
+	})
+	if s.ringbuffer_size != 0 {
+		s.inspector.metablock().OutputOffset += int64(unwrittenBytes(s, false))
+	}
+}
+
+func inspectMetablockHeader(s *Reader) {
+	var mb *MetablockStructure = s.inspector.metablock()
+	mb.Length = s.meta_block_remaining_len
+	mb.IsLast = s.is_last_metablock != 0
+	mb.IsUncompressed = s.is_uncompressed != 0
+	mb.IsMetadata = s.is_metadata != 0
+}
+
+/* Records the prefix code that readHuffmanCode has just read, before the
+   decoding table is built from it. Which code it is follows from the state
+   of the decoder. */
+func inspectPrefixCode(s *Reader, alphabet_size uint32, simple bool) {
+	var mb *MetablockStructure = s.inspector.metablock()
+	var code PrefixCode
+	code.AlphabetSize = int(alphabet_size)
+	code.Simple = simple
+	if simple {
+		/* Code lengths of the listed symbols, in the order they are listed;
+		   4 stands for four symbols with the second tree shape. */
+		var simple_lengths = [5][]int{{0}, {1, 1}, {1, 2, 2}, {2, 2, 2, 2}, {1, 2, 3, 3}}
+		var i int
+		var l int
+		for i, l = range simple_lengths[s.symbol] {
+			code.Symbols = append(code.Symbols, int(s.symbols_lists_array[i]))
+			code.Lengths = append(code.Lengths, l)
+		}
+
+		sort.Sort(&code)
+	} else {
+		/* The symbols of each code length are chained in symbol_lists, in
+		   increasing order. */
+		var lengths [0x800]byte
+		var bits int
+		var i int
+		for bits = 1; bits <= huffmanMaxCodeLength; bits++ {
+			var symbol int = bits - (huffmanMaxCodeLength + 1)
+			var n int
+			for n = int(s.code_length_histo[bits]); n != 0; n-- {
+				symbol = int(symbolListGet(s.symbol_lists, symbol))
+				lengths[symbol] = byte(bits)
+			}
+		}
+
+		for i = 0; i < int(alphabet_size); i++ {
+			if lengths[i] != 0 {
+				code.Symbols = append(code.Symbols, i)
+				code.Lengths = append(code.Lengths, int(lengths[i]))
+			}
+		}
+	}
+
+	switch s.state {
+	case stateHuffmanCode1:
+		mb.category(s.loop_counter).BlockTypeCode = &code
+	case stateHuffmanCode2:
+		mb.category(s.loop_counter).BlockCountCode = &code
+	case stateTreeGroup:
+		var c *CategoryStructure = mb.category(s.loop_counter)
+		c.Codes = append(c.Codes, code)
+	}
+
+	/* The codes of the context maps themselves are not reported. */
+}
+
+func inspectTreeGroups(s *Reader) {
+	var mb *MetablockStructure = s.inspector.metablock()
+	var i int
+	mb.DistancePostfixBits = int(s.distance_postfix_bits)
+	mb.DirectDistanceCodes = int(s.num_direct_distance_codes - numDistanceShortCodes)
+	mb.ContextModes = make([]ContextMode, len(s.context_modes))
+	for i = range s.context_modes {
+		mb.ContextModes[i] = ContextMode(s.context_modes[i])
+	}
+
+	for i = 0; i < 3; i++ {
+		var c *CategoryStructure = mb.category(i)
+		c.BlockTypes = int(s.num_block_types[i])
+		if c.BlockTypes > 1 {
+			c.Blocks = append(c.Blocks, Block{Type: 0, Length: int(s.block_length[i])})
+		}
+	}
+
+	mb.Literals.Trees = int(s.num_literal_htrees)
+	mb.Commands.Trees = int(s.num_block_types[1])
+	mb.Distances.Trees = int(s.num_dist_htrees)
+	mb.Literals.ContextMap = make([]int, len(s.context_map))
+	for i = range s.context_map {
+		mb.Literals.ContextMap[i] = int(s.context_map[i])
+	}
+
+	mb.Distances.ContextMap = make([]int, len(s.dist_context_map))
+	for i = range s.dist_context_map {
+		mb.Distances.ContextMap[i] = int(s.dist_context_map[i])
+	}
+}
+
+func inspectBlockSwitch(s *Reader, tree_type int, block_type uint32) {
+	var c *CategoryStructure = s.inspector.metablock().category(tree_type)
+	c.Blocks = append(c.Blocks, Block{Type: int(block_type), Length: int(s.block_length[tree_type])})
+}
+
+// Info describes a stream checked by Verify.
+type Info struct {
+	// DecodedSize is the size of the decompressed data, and CompressedSize
+	// the length of the stream.
+	DecodedSize    int64
+	CompressedSize int64
+	// WindowBits is the base 2 logarithm of the sliding window size
+	// declared by the stream header.
+	WindowBits int
+	// Metablocks is the number of metablocks, including metadata and empty
+	// ones.
+	Metablocks int
+}
+
+// Verify checks that src holds one valid stream, the way "gzip -t" does. It
+// runs the decoder to the end of the stream, throwing the output away as it
+// leaves the sliding window, so that no memory is spent on it. If the stream
+// is invalid, the error is a *DecodeError giving the position of the
+// failure, or io.ErrUnexpectedEOF if the stream is cut short, and Info
+// covers what was decoded before it.
+func Verify(src io.Reader) (Info, error) {
+	return VerifyOptions(src, ReaderOptions{})
+}
+
+// VerifyOptions is like Verify, but decodes the stream with the given
+// options, for instance to give its Dictionary or to allow a LargeWindow.
+func VerifyOptions(src io.Reader, options ReaderOptions) (Info, error) {
+	r := NewReaderOptions(src, options)
+	_, err := r.WriteTo(ioutil.Discard)
+	info := Info{
+		DecodedSize:    int64(r.partial_pos_out),
+		CompressedSize: int64(r.total_in),
+		WindowBits:     int(r.window_bits),
+		Metablocks:     int(r.metablock_count),
+	}
+	return info, err
+}
@@ -0,0 +1,237 @@
+package brotli
+
+import (
+	"bytes"
+	"runtime"
+)
+
+// parallelWriter is the state of a Writer in parallel mode, when
+// WriterOptions.ChunkSize is positive. The input is cut into chunks, which
+// are compressed concurrently by encoders of their own, each taking up the
+// stream where the previous chunk ends (see encoderContinueStream). The
+// Writer's own encoder only writes the stream header, metadata blocks and
+// the empty metablock that ends the stream.
+type parallelWriter struct {
+	options   WriterOptions // for the chunk encoders
+	chunkSize int
+
+	// encoders holds the idle chunk encoders, nil for those not created yet.
+	// Its capacity is the number of chunks compressed at the same time.
+	encoders chan *Writer
+
+	buf     []byte      // input not dispatched yet
+	prev    []byte      // the last two bytes before buf
+	offset  int64       // position of buf in the input
+	pending []*chunkJob // dispatched chunks not written yet, in input order
+	err     error       // once set, the stream is broken
+
+	// chunkWritten, if set, is called for every chunk once its output has
+	// been written, at position start in the compressed stream. It is used
+	// by SeekableWriter to build its seek table.
+	chunkWritten func(job *chunkJob, start int64)
+}
+
+// chunkJob is the compression of one chunk.
+type chunkJob struct {
+	offset int64
+	size   int
+	prev   []byte // the last two bytes before the chunk
+	out    bytes.Buffer
+	stats  WriterStats
+	trace  []MetablockInfo
+	err    error
+	done   chan struct{}
+}
+
+// resetParallel sets up parallel mode for a Writer that has just been reset.
+// The encoders of an earlier stream are kept if the concurrency is the same.
+func (w *Writer) resetParallel() {
+	ensureInitialized(w)
+
+	opts := w.options
+	opts.LGWin = int(w.params.lgwin)
+	opts.ChunkSize = 0
+	opts.Concurrency = 0
+	opts.MetablockTrace = nil
+
+	concurrency := w.options.Concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	var encoders chan *Writer
+	if w.parallel != nil && cap(w.parallel.encoders) == concurrency {
+		encoders = w.parallel.encoders
+	} else {
+		encoders = make(chan *Writer, concurrency)
+		for i := 0; i < concurrency; i++ {
+			encoders <- nil
+		}
+	}
+
+	w.parallel = &parallelWriter{
+		options:   opts,
+		chunkSize: w.options.ChunkSize,
+		encoders:  encoders,
+	}
+}
+
+func (p *parallelWriter) write(w *Writer, b []byte) (n int, err error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+	for len(b) > 0 {
+		m := p.chunkSize - len(p.buf)
+		if m > len(b) {
+			m = len(b)
+		}
+		p.buf = append(p.buf, b[:m]...)
+		b = b[m:]
+		n += m
+		w.bytes_in_ += uint64(m)
+		if len(p.buf) == p.chunkSize {
+			if err := p.dispatch(w); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// dispatch starts compressing the buffered input as a chunk, and writes the
+// output of the chunks that are done.
+func (p *parallelWriter) dispatch(w *Writer) error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+
+	data, prev := p.buf, p.prev
+	job := &chunkJob{offset: p.offset, size: len(data), prev: prev, done: make(chan struct{})}
+	tail := data
+	if len(tail) > 2 {
+		tail = tail[len(tail)-2:]
+	}
+	p.prev = append(append([]byte(nil), prev...), tail...)
+	if len(p.prev) > 2 {
+		p.prev = p.prev[len(p.prev)-2:]
+	}
+	p.offset += int64(len(data))
+	p.buf = nil
+
+	opts := p.options
+	opts.SizeHint = len(data)
+	if w.options.MetablockTrace != nil {
+		opts.MetablockTrace = func(info MetablockInfo) {
+			job.trace = append(job.trace, info)
+		}
+	}
+	encoders := p.encoders
+	e := <-encoders
+	if e == nil {
+		e = &Writer{dictionary: w.dictionary}
+	}
+	go func() {
+		job.run(e, opts, prev, data)
+		encoders <- e
+	}()
+
+	p.pending = append(p.pending, job)
+	return p.drain(w, false)
+}
+
+func (job *chunkJob) run(e *Writer, opts WriterOptions, prev, data []byte) {
+	defer close(job.done)
+	e.options = opts
+	e.Reset(&job.out)
+	if !encoderContinueStream(e, uint64(job.offset), prev) {
+		job.err = errEncode
+		return
+	}
+	if _, job.err = e.Write(data); job.err == nil {
+		job.err = e.Flush()
+	}
+	job.stats = e.Stats()
+}
+
+// drain writes the output of the pending chunks that are done, in order.
+// If all is set, it waits for all of them; otherwise it only waits while
+// there are more than twice as many pending chunks as encoders, to bound
+// the memory held by finished chunks stuck behind a slow one.
+func (p *parallelWriter) drain(w *Writer, all bool) error {
+	for len(p.pending) > 0 {
+		job := p.pending[0]
+		if all || len(p.pending) > 2*cap(p.encoders) {
+			<-job.done
+		} else {
+			select {
+			case <-job.done:
+			default:
+				return nil
+			}
+		}
+		p.pending[0] = nil
+		p.pending = p.pending[1:]
+
+		if err := p.writeJob(w, job); err != nil {
+			p.err = err
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *parallelWriter) writeJob(w *Writer, job *chunkJob) error {
+	if job.err != nil {
+		return job.err
+	}
+	if err := p.writeHeader(w); err != nil {
+		return err
+	}
+	if _, err := w.dst.Write(job.out.Bytes()); err != nil {
+		return err
+	}
+
+	if p.chunkWritten != nil {
+		p.chunkWritten(job, int64(w.total_out_))
+	}
+	w.total_out_ += uint(job.out.Len())
+	w.metablocks_.compressed += uint64(job.stats.CompressedMetablocks)
+	w.metablocks_.uncompressed += uint64(job.stats.UncompressedMetablocks)
+	for _, info := range job.trace {
+		info.Offset += job.offset
+		w.options.MetablockTrace(info)
+	}
+	return nil
+}
+
+// writeHeader writes the stream header, padded to a byte boundary, unless
+// it has been written already.
+func (p *parallelWriter) writeHeader(w *Writer) error {
+	if w.last_bytes_bits_ == 0 {
+		return nil
+	}
+	injectBytePaddingBlock(w)
+	_, err := w.dst.Write(encoderTakeOutput(w))
+	return err
+}
+
+// flush compresses the buffered input, even if it does not fill a chunk,
+// and writes the output of all the chunks.
+func (p *parallelWriter) flush(w *Writer) error {
+	if p.err != nil {
+		return p.err
+	}
+	if err := p.dispatch(w); err != nil {
+		return err
+	}
+	return p.drain(w, true)
+}
+
+// close ends the stream.
+func (p *parallelWriter) close(w *Writer) error {
+	if err := p.flush(w); err != nil {
+		return err
+	}
+	injectLastEmptyMetaBlock(w)
+	_, err := w.dst.Write(encoderTakeOutput(w))
+	return err
+}
@@ -0,0 +1,217 @@
+package brotli
+
+import (
+	"io"
+	"runtime"
+)
+
+// ParallelReader decompresses a stream written by a SeekableWriter from
+// start to end, like a Reader, but decodes several of its frames at the
+// same time. The seek table tells where the frames are; each is decoded by a
+// decoder of its own, and the output is handed out in order. Frames are
+// read ahead of the data returned by Read, up to twice as many as are
+// decoded at the same time.
+//
+// If ReaderOptions.MemoryLimit is set, it bounds the total memory of the
+// ParallelReader: the sliding windows and Huffman tables of its decoders,
+// and the buffers of the frames it holds. The limit is divided into a
+// budget for each decoder, which is at most what the largest tables can
+// take, and the rest is left to the buffers. Fewer decoders are used than
+// ReaderOptions.Concurrency asks for when the limit does not leave each of
+// them room for the largest frame.
+type ParallelReader struct {
+	sr          *SeekableReader
+	memoryLimit int64
+
+	// decoders holds the idle decoders, nil for those not created yet. Its
+	// capacity is the number of frames decoded at the same time.
+	decoders chan *Reader
+
+	next     int         // index of the next frame to dispatch
+	pending  []*frameJob // dispatched frames not read yet, in order
+	reserved int64       // memory of the decoders and of all the buffers
+	cur      *frameJob   // the frame being read
+	out      []byte      // the part of cur not read yet
+	free     [][]byte    // buffers of frames that have been read
+	err      error       // once set, reading is over
+}
+
+// frameJob is the decoding of one frame. Its buffer holds the compressed
+// data of the frame followed by out.
+type frameJob struct {
+	frame *seekFrame
+	buf   []byte
+	out   []byte
+	err   error
+	done  chan struct{}
+}
+
+// NewParallelReader reads the seek table of the stream of size bytes in src,
+// and returns a ParallelReader for it. It returns ErrNoSeekTable if the
+// stream does not have one, and ErrMemoryLimit if the largest frame and a
+// decoder for it do not fit in options.MemoryLimit. src must allow
+// concurrent calls to ReadAt, as io.ReaderAt requires. Of the options,
+// MaxDecodedSize, MetadataCallback and StopAtStreamEnd are ignored.
+func NewParallelReader(src io.ReaderAt, size int64, options ReaderOptions) (*ParallelReader, error) {
+	sr, err := NewSeekableReader(src, size, options)
+	if err != nil {
+		return nil, err
+	}
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	r := &ParallelReader{sr: sr, memoryLimit: options.MemoryLimit}
+	if r.memoryLimit > 0 && len(sr.frames) > 0 {
+		if n := r.memoryLimit / (sr.frameDecoderMemory() + sr.maxFrameMemory()); n < int64(concurrency) {
+			concurrency = int(n)
+			if concurrency < 1 {
+				concurrency = 1
+			}
+		}
+		limit, err := sr.decoderMemoryLimit(r.memoryLimit, concurrency)
+		if err != nil {
+			return nil, err
+		}
+		sr.options.MemoryLimit = limit
+		r.reserved = int64(concurrency) * limit
+	}
+	r.decoders = make(chan *Reader, concurrency)
+	for i := 0; i < concurrency; i++ {
+		r.decoders <- nil
+	}
+	return r, nil
+}
+
+// Size returns the size of the decompressed data.
+func (r *ParallelReader) Size() int64 {
+	return r.sr.size
+}
+
+// dispatch starts decoding frames, as long as the read-ahead and the
+// memory limit allow it.
+func (r *ParallelReader) dispatch() {
+	for r.next < len(r.sr.frames) && len(r.pending) < 2*cap(r.decoders) {
+		f := &r.sr.frames[r.next]
+		buf := r.buffer(f.compressedSize + f.size)
+		if buf == nil {
+			// Wait for the frames ahead to be read.
+			return
+		}
+		r.next++
+
+		job := &frameJob{frame: f, buf: buf, out: buf[f.compressedSize:], done: make(chan struct{})}
+		decoders := r.decoders
+		go func() {
+			defer close(job.done)
+			d := <-decoders
+			if d == nil {
+				d = new(Reader)
+			}
+			job.err = r.sr.decodeFrame(d, job.frame, job.buf[:job.frame.compressedSize], job.out)
+			decoders <- d
+		}()
+		r.pending = append(r.pending, job)
+	}
+}
+
+// buffer returns a buffer of n bytes, reusing one of a frame that has been
+// read if it is big enough. Otherwise it drops the buffers that are not,
+// as long as the new one does not fit in the memory limit, and returns nil
+// if it still does not.
+func (r *ParallelReader) buffer(n int) []byte {
+	for i, b := range r.free {
+		if cap(b) >= n {
+			r.free[i] = r.free[len(r.free)-1]
+			r.free[len(r.free)-1] = nil
+			r.free = r.free[:len(r.free)-1]
+			return b[:n]
+		}
+	}
+	if r.memoryLimit > 0 {
+		for len(r.free) > 0 && r.reserved+int64(n) > r.memoryLimit {
+			r.reserved -= int64(cap(r.free[len(r.free)-1]))
+			r.free[len(r.free)-1] = nil
+			r.free = r.free[:len(r.free)-1]
+		}
+		if r.reserved+int64(n) > r.memoryLimit {
+			return nil
+		}
+	}
+	r.reserved += int64(n)
+	return make([]byte, n)
+}
+
+// nextFrame waits for the next frame to be decoded and makes it the current
+// one. It returns io.EOF after the last frame.
+func (r *ParallelReader) nextFrame() error {
+	if r.err != nil {
+		return r.err
+	}
+	if r.cur != nil {
+		if len(r.free) < cap(r.decoders) {
+			r.free = append(r.free, r.cur.buf)
+		} else {
+			r.reserved -= int64(cap(r.cur.buf))
+		}
+		r.cur = nil
+	}
+	r.dispatch()
+	if len(r.pending) == 0 {
+		r.err = io.EOF
+		if r.next < len(r.sr.frames) {
+			// Not reached: NewParallelReader leaves room for any frame
+			// once the others have been read.
+			r.err = ErrMemoryLimit
+		}
+		return r.err
+	}
+	job := r.pending[0]
+	<-job.done
+	r.pending[0] = nil
+	r.pending = r.pending[1:]
+	if job.err != nil {
+		r.err = job.err
+		return r.err
+	}
+	r.cur = job
+	r.out = job.out
+	r.dispatch()
+	return nil
+}
+
+// Read implements io.Reader.
+func (r *ParallelReader) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for len(r.out) == 0 {
+		if err := r.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// WriteTo implements io.WriterTo. It writes the decoded frames to w
+// straight from their buffers.
+func (r *ParallelReader) WriteTo(w io.Writer) (n int64, err error) {
+	for {
+		for len(r.out) == 0 {
+			if err := r.nextFrame(); err != nil {
+				if err == io.EOF {
+					return n, nil
+				}
+				return n, err
+			}
+		}
+		m, err := w.Write(r.out)
+		n += int64(m)
+		r.out = r.out[m:]
+		if err != nil {
+			return n, err
+		}
+	}
+}
@@ -34,4 +34,10 @@ type encoderParams struct {
 	hasher                           hasherParams
 	dist                             distanceParams
 	dictionary                       encoderDictionary
+
+	/* Number of bytes the decoder has seen before the encoder's first byte,
+	   when it takes up a stream where another encoder left it; at most the
+	   window size. Static and custom dictionary references are numbered from
+	   the decoder's position, so they are shifted by it. */
+	stream_offset uint
 }
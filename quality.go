@@ -102,6 +102,18 @@ func computeLgBlock(params *encoderParams) int {
 	return lgblock
 }
 
+/* Returns the smallest window that reaches back over an input of the given
+   size, but no more than the default window: for inputs that are known to be
+   small, a bigger window would only cost memory. */
+func computeLgWinForSize(size uint) uint {
+	var lgwin uint = minWindowBits
+	for lgwin < defaultWindow && maxBackwardLimit(lgwin) < size {
+		lgwin++
+	}
+
+	return lgwin
+}
+
 /* Returns log2 of the size of main ring buffer area.
    Allocate at least lgwin + 1 bits for the ring buffer so that the newly
    added block fits there completely and we still get lgwin bits and at least
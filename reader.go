@@ -2,18 +2,232 @@ package brotli
 
 import (
 	"errors"
+	"fmt"
 	"io"
 )
 
-type decodeError int
-
-func (err decodeError) Error() string {
-	return "brotli: " + string(decoderErrorString(int(err)))
-}
-
 var errExcessiveInput = errors.New("brotli: excessive input")
 var errInvalidState = errors.New("brotli: invalid state")
 var errReaderClosed = errors.New("brotli: Reader is closed")
+var errLargeWindow = errors.New("brotli: stream uses a large window; set ReaderOptions.LargeWindow to decode it")
+
+// ErrOutputLimit is matched by the errors.Is function for decode errors that
+// are caused by decompressed data growing past ReaderOptions.MaxDecodedSize.
+var ErrOutputLimit = errors.New("brotli: decompressed data exceeds MaxDecodedSize")
+
+// ErrMemoryLimit is matched by the errors.Is function for decode errors that
+// are caused by a stream needing a bigger window than
+// ReaderOptions.MaxWindowBits or more memory than ReaderOptions.MemoryLimit.
+var ErrMemoryLimit = errors.New("brotli: stream needs more memory than the Reader allows")
+
+// ErrCorrupt is matched by the errors.Is function for decode errors that are
+// caused by invalid compressed data.
+var ErrCorrupt = errors.New("brotli: corrupt input")
+
+// ErrorCode identifies why the decoder rejected a stream. The values match
+// those of the reference decoder where it has an equivalent.
+//
+// The errors.Is function matches a DecodeError with ErrorOutputLimit to
+// ErrOutputLimit, one with ErrorWindowLimit or one of the ErrorAlloc codes to
+// ErrMemoryLimit, and one with any other code to ErrCorrupt, except for
+// ErrorInvalidArguments and ErrorUnreachable, which match neither, and
+// ErrorFormatWindowBits on a stream that uses a large window while
+// ReaderOptions.LargeWindow is not set, which does not match ErrCorrupt.
+type ErrorCode int
+
+// Format errors: the compressed data is invalid.
+const (
+	// ErrorFormatExuberantNibble reports a metablock length with a
+	// superfluous leading zero nibble.
+	ErrorFormatExuberantNibble ErrorCode = decoderErrorFormatExuberantNibble
+	// ErrorFormatReserved reports a reserved bit that is set.
+	ErrorFormatReserved ErrorCode = decoderErrorFormatReserved
+	// ErrorFormatExuberantMetaNibble reports a metadata length with a
+	// superfluous leading zero byte.
+	ErrorFormatExuberantMetaNibble ErrorCode = decoderErrorFormatExuberantMetaNibble
+	// ErrorFormatSimpleHuffmanAlphabet reports a simple prefix code with a
+	// symbol outside its alphabet.
+	ErrorFormatSimpleHuffmanAlphabet ErrorCode = decoderErrorFormatSimpleHuffmanAlphabet
+	// ErrorFormatSimpleHuffmanSame reports a simple prefix code that lists
+	// a symbol twice.
+	ErrorFormatSimpleHuffmanSame ErrorCode = decoderErrorFormatSimpleHuffmanSame
+	// ErrorFormatClSpace reports code length code lengths that do not make
+	// a complete prefix code.
+	ErrorFormatClSpace ErrorCode = decoderErrorFormatClSpace
+	// ErrorFormatHuffmanSpace reports code lengths that do not make a
+	// complete prefix code.
+	ErrorFormatHuffmanSpace ErrorCode = decoderErrorFormatHuffmanSpace
+	// ErrorFormatContextMapRepeat reports a context map whose run of zeros
+	// goes past its end.
+	ErrorFormatContextMapRepeat ErrorCode = decoderErrorFormatContextMapRepeat
+	// ErrorFormatBlockLength1 reports a metablock whose data goes past its
+	// length, found while its output is written.
+	ErrorFormatBlockLength1 ErrorCode = decoderErrorFormatBlockLength1
+	// ErrorFormatBlockLength2 reports a metablock whose data goes past its
+	// length, found at its end.
+	ErrorFormatBlockLength2 ErrorCode = decoderErrorFormatBlockLength2
+	// ErrorFormatTransform reports a static dictionary reference with an
+	// invalid transform.
+	ErrorFormatTransform ErrorCode = decoderErrorFormatTransform
+	// ErrorFormatDictionary reports a static dictionary reference with an
+	// invalid word length.
+	ErrorFormatDictionary ErrorCode = decoderErrorFormatDictionary
+	// ErrorFormatWindowBits reports an invalid window size in the stream
+	// header.
+	ErrorFormatWindowBits ErrorCode = decoderErrorFormatWindowBits
+	// ErrorFormatPadding1 reports nonzero padding bits before an
+	// uncompressed or metadata block.
+	ErrorFormatPadding1 ErrorCode = decoderErrorFormatPadding1
+	// ErrorFormatPadding2 reports nonzero padding bits at the end of the
+	// stream.
+	ErrorFormatPadding2 ErrorCode = decoderErrorFormatPadding2
+	// ErrorFormatDistance reports a distance larger than the format allows.
+	ErrorFormatDistance ErrorCode = decoderErrorFormatDistance
+	// ErrorCompoundDictionary reports a reference beyond the start of the
+	// custom dictionary, or into one that was not given.
+	ErrorCompoundDictionary ErrorCode = decoderErrorCompoundDictionary
+	// ErrorDictionaryNotSet reports a static dictionary reference while no
+	// static dictionary is available.
+	ErrorDictionaryNotSet ErrorCode = decoderErrorDictionaryNotSet
+)
+
+// Misuse errors: the decoder was called in a way it does not support.
+const (
+	// ErrorInvalidArguments reports invalid arguments to the decoder.
+	ErrorInvalidArguments ErrorCode = decoderErrorInvalidArguments
+	// ErrorUnreachable reports an internal inconsistency of the decoder.
+	ErrorUnreachable ErrorCode = decoderErrorUnreachable
+)
+
+// Limit errors: the stream needs more memory or produces more output than
+// the ReaderOptions allow.
+const (
+	// ErrorAllocContextModes reports that the context modes would exceed
+	// ReaderOptions.MemoryLimit.
+	ErrorAllocContextModes ErrorCode = decoderErrorAllocContextModes
+	// ErrorAllocTreeGroups reports that the prefix codes would exceed
+	// ReaderOptions.MemoryLimit.
+	ErrorAllocTreeGroups ErrorCode = decoderErrorAllocTreeGroups
+	// ErrorAllocContextMap reports that the context maps would exceed
+	// ReaderOptions.MemoryLimit.
+	ErrorAllocContextMap ErrorCode = decoderErrorAllocContextMap
+	// ErrorAllocRingBuffer1 reports that the sliding window would exceed
+	// ReaderOptions.MemoryLimit, found at the start of a metablock.
+	ErrorAllocRingBuffer1 ErrorCode = decoderErrorAllocRingBuffer1
+	// ErrorAllocRingBuffer2 reports that the sliding window would exceed
+	// ReaderOptions.MemoryLimit, found once the prefix codes of a
+	// compressed metablock are read.
+	ErrorAllocRingBuffer2 ErrorCode = decoderErrorAllocRingBuffer2
+	// ErrorAllocBlockTypeTrees reports that the tables of the block type
+	// codes could not be allocated.
+	ErrorAllocBlockTypeTrees ErrorCode = decoderErrorAllocBlockTypeTrees
+	// ErrorOutputLimit reports output beyond ReaderOptions.MaxDecodedSize.
+	ErrorOutputLimit ErrorCode = decoderErrorOutputLimit
+	// ErrorWindowLimit reports a window larger than
+	// ReaderOptions.MaxWindowBits.
+	ErrorWindowLimit ErrorCode = decoderErrorWindowLimit
+	// ErrorAllocMetadata reports that the payload of a metadata block, kept
+	// for ReaderOptions.MetadataCallback, would exceed
+	// ReaderOptions.MemoryLimit.
+	ErrorAllocMetadata ErrorCode = decoderErrorAllocMetadata
+)
+
+func (c ErrorCode) String() string {
+	return decoderErrorString(int(c))
+}
+
+// DecodeError is the error returned by Read and Decode when the decoder
+// rejects a stream. Depending on Code, it matches ErrCorrupt, ErrMemoryLimit
+// or ErrOutputLimit with the errors.Is function.
+type DecodeError struct {
+	Code ErrorCode
+	// Offset and Bit give the position in the compressed stream of the first
+	// bit that the decoder had not consumed when it failed: bit Bit, counting
+	// from the least significant one, of byte Offset.
+	Offset int64
+	Bit    int
+	// OutputOffset is the number of bytes decompressed before the failure.
+	OutputOffset int64
+	// Metablock is the index of the metablock being decoded, counting from 0.
+	Metablock int
+
+	err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%v: %v at byte %d, bit %d (output offset %d, metablock %d)", e.err, e.Code, e.Offset, e.Bit, e.OutputOffset, e.Metablock)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.err
+}
+
+// ReaderOptions configures Reader.
+type ReaderOptions struct {
+	// LargeWindow allows decoding streams produced with the "Large Window
+	// Brotli" extension (see WriterOptions.LargeWindow). Such streams may
+	// need up to 1 GiB of memory for the sliding window.
+	LargeWindow bool
+	// MetadataCallback, if set, is called by Read for every metadata block in
+	// the stream (see Writer.WriteMetadata). offset is the number of
+	// decompressed bytes that precede the block; all of them have been
+	// copied to the buffers passed to Read before the callback is made, and
+	// none of the bytes that follow it. payload is only valid during the call.
+	// Empty metadata blocks, which only pad the stream to a byte boundary,
+	// are not reported. The payload, up to 16 MiB, is held until the end of
+	// the block, and counts against MemoryLimit.
+	MetadataCallback func(offset int64, payload []byte)
+	// Dictionary is the custom dictionary the stream was compressed with
+	// (see WriterOptions.Dictionary). Decoding a stream that uses one
+	// without it fails.
+	Dictionary []byte
+	// MaxDecodedSize, if positive, is the most decompressed data the Reader
+	// will produce. Read hands out the data up to the limit, then fails with
+	// ErrOutputLimit, so that a small malicious input cannot expand to an
+	// arbitrary amount of output. The decoder never runs more than one
+	// window ahead of the data handed out.
+	MaxDecodedSize int64
+	// MaxWindowBits, if positive, is the base 2 logarithm of the largest
+	// sliding window the Reader accepts. Streams that ask for a bigger one
+	// fail with ErrMemoryLimit before it is allocated. Standard streams use
+	// windows of 2^10 to 2^24 bytes, large window streams up to 2^30.
+	MaxWindowBits int
+	// MemoryLimit, if positive, is the most memory in bytes that the Reader
+	// may hold for its sliding window, Huffman tables and context maps,
+	// counting both the old and the new window while the window grows.
+	// Streams that need more fail with ErrMemoryLimit before the memory is
+	// allocated. For a
+	// SeekableReader or a ParallelReader, the limit also covers the buffers
+	// of the frames it holds, and is shared by all the decoders of a
+	// ParallelReader.
+	MemoryLimit int64
+	// DisableRingBufferReallocation makes the Reader allocate the whole
+	// sliding window at the start of the stream. By default it starts with a
+	// buffer just big enough for the first metablock and grows it as
+	// needed, which saves memory on short streams but copies the buffer
+	// each time it grows.
+	DisableRingBufferReallocation bool
+	// StopAtStreamEnd makes the end of the compressed stream a normal end of
+	// file: Read and WriteTo report io.EOF there, instead of failing if more
+	// data follows in the source. Stats().BytesIn is then the exact length of
+	// the stream, and Unread returns what was read past its end. If the
+	// source is a *bufio.Reader or implements io.ByteReader, the Reader
+	// consumes nothing past the end of the stream, so that the source is
+	// left right after it. Reading through io.ByteReader takes one byte at a
+	// time, which is slow; a *bufio.Reader avoids that.
+	StopAtStreamEnd bool
+	// Concurrency is the number of frames a ParallelReader decodes at the
+	// same time. 0 means runtime.GOMAXPROCS(0). Other readers ignore it.
+	Concurrency int
+}
+
+// bufferedReader is implemented by *bufio.Reader. It lets the Reader decode
+// straight from the source's buffer and consume only what it decodes.
+type bufferedReader interface {
+	Buffered() int
+	Peek(n int) ([]byte, error)
+	Discard(n int) (int, error)
+}
 
 // readBufSize is a "good" buffer size that avoids excessive round-trips
 // between C and Go but doesn't waste too much memory on buffering.
@@ -22,21 +236,164 @@ const readBufSize = 32 * 1024
 
 // NewReader initializes new Reader instance.
 func NewReader(src io.Reader) *Reader {
-	r := new(Reader)
-	decoderStateInit(r)
-	r.src = src
-	r.buf = make([]byte, readBufSize)
+	return NewReaderOptions(src, ReaderOptions{})
+}
+
+// NewReaderOptions initializes new Reader instance with the given options.
+func NewReaderOptions(src io.Reader, options ReaderOptions) *Reader {
+	r := &Reader{options: options}
+	r.Reset(src)
 	return r
 }
 
+// Reset discards the Reader's state and makes it equivalent to the result of
+// NewReaderOptions with the original options, but reading from src instead.
+// Buffers allocated for earlier streams are kept, so that reusing a Reader is
+// cheaper than creating a new one. Multistream is turned off again.
+func (r *Reader) Reset(src io.Reader) error {
+	r.initDecoder()
+	r.multistream = false
+	r.src = src
+	r.peeker = nil
+	r.byteSrc = nil
+	if r.options.StopAtStreamEnd {
+		if b, ok := src.(bufferedReader); ok {
+			r.peeker = b
+		} else if b, ok := src.(io.ByteReader); ok {
+			r.byteSrc = b
+		}
+	}
+	if r.buf == nil {
+		r.buf = make([]byte, readBufSize)
+	}
+	r.in = nil
+	r.peeked = 0
+	return nil
+}
+
+func (r *Reader) initDecoder() {
+	decoderStateInit(r)
+	if r.options.LargeWindow {
+		decoderSetParameter(r, decoderParamLargeWindow, 1)
+	}
+	if r.options.DisableRingBufferReallocation {
+		decoderSetParameter(r, decoderParamDisableRingBufferReallocation, 1)
+	}
+}
+
+// Multistream controls whether the Reader supports concatenated streams,
+// such as the output of "cat a.br b.br". If enabled, which it is not by
+// default, Read decodes the streams one after the other as a single one.
+// Otherwise, Read fails at the end of the first stream if more data follows,
+// or returns io.EOF with ReaderOptions.StopAtStreamEnd; NextStream then
+// starts on the following stream. This way each stream can be told apart,
+// and its Stats inspected, for example its WindowSize.
+// Stats only ever cover the current stream.
+func (r *Reader) Multistream(ok bool) {
+	r.multistream = ok
+}
+
+// NextStream starts decoding the stream that follows the current one, which
+// must have been read to its end, from the same source. It returns io.EOF if
+// no data follows. See Multistream.
+func (r *Reader) NextStream() error {
+	if r.state != stateDone || decoderHasMoreOutput(r) {
+		return errInvalidState
+	}
+	for i := 0; len(r.in) == 0; i++ {
+		m, err := r.readInput()
+		if m == 0 && err != nil {
+			return err
+		}
+		if m == 0 && i >= 100 {
+			return io.ErrNoProgress
+		}
+	}
+	r.initDecoder()
+	return nil
+}
+
+// readInput refills r.in, which must be empty, from r.src.
+func (r *Reader) readInput() (int, error) {
+	switch {
+	case r.peeker != nil:
+		// All of the data peeked last time has been decoded.
+		r.peeker.Discard(r.peeked)
+		r.peeked = 0
+		n := r.peeker.Buffered()
+		if n == 0 {
+			if _, err := r.peeker.Peek(1); err != nil {
+				return 0, err
+			}
+			n = r.peeker.Buffered()
+		}
+		r.in, _ = r.peeker.Peek(n)
+		r.peeked = n
+		return n, nil
+	case r.byteSrc != nil:
+		c, err := r.byteSrc.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		r.buf[0] = c
+		r.in = r.buf[:1]
+		return 1, nil
+	}
+	m, err := r.src.Read(r.buf)
+	r.in = r.buf[:m]
+	return m, err
+}
+
+// streamEnded checks the input left over at the end of the stream. In
+// StopAtStreamEnd mode, it leaves the input after the stream in the source,
+// as far as possible.
+func (r *Reader) streamEnded() error {
+	if !r.options.StopAtStreamEnd {
+		if len(r.in) > 0 {
+			return errExcessiveInput
+		}
+		return nil
+	}
+	if r.peeker != nil {
+		r.peeker.Discard(r.peeked - len(r.in))
+		r.peeked = 0
+		r.in = nil
+	}
+	return io.EOF
+}
+
+// Unread returns the input that the Reader has read from its source but not
+// decoded. Once a stream read with ReaderOptions.StopAtStreamEnd has ended,
+// this is the beginning of the data that follows it. The slice is only valid
+// until the next call to Read, WriteTo or Reset.
+func (r *Reader) Unread() []byte {
+	if r.peeker != nil {
+		// Anything not decoded is still in the source.
+		return nil
+	}
+	return r.in
+}
+
 func (r *Reader) Read(p []byte) (n int, err error) {
+	if r.state == stateDone && !decoderHasMoreOutput(r) {
+		if r.multistream {
+			if err := r.NextStream(); err != nil {
+				return 0, err
+			}
+		} else if r.options.StopAtStreamEnd {
+			return 0, io.EOF
+		}
+	}
 	if !decoderHasMoreOutput(r) && len(r.in) == 0 {
-		m, readErr := r.src.Read(r.buf)
+		m, readErr := r.readInput()
 		if m == 0 {
+			if readErr == io.EOF && r.total_in != 0 && r.state != stateDone {
+				// The stream was cut short.
+				return 0, io.ErrUnexpectedEOF
+			}
 			// If readErr is `nil`, we just proxy underlying stream behavior.
 			return 0, readErr
 		}
-		r.in = r.buf[:m]
 	}
 
 	if len(p) == 0 {
@@ -50,17 +407,28 @@ func (r *Reader) Read(p []byte) (n int, err error) {
 		in_remaining := in_len
 		out_remaining := out_len
 		result := decoderDecompressStream(r, &in_remaining, &r.in, &out_remaining, &p)
+		r.total_in += uint64(in_len - in_remaining)
 		written = out_len - out_remaining
 		n = int(written)
 
 		switch result {
 		case decoderResultSuccess:
-			if len(r.in) > 0 {
-				return n, errExcessiveInput
+			if r.multistream {
+				if n > 0 {
+					return n, nil
+				}
+				if err := r.NextStream(); err != nil {
+					return 0, err
+				}
+				continue
 			}
-			return n, nil
+			err := r.streamEnded()
+			if err == io.EOF && n > 0 {
+				err = nil
+			}
+			return n, err
 		case decoderResultError:
-			return n, decodeError(decoderGetErrorCode(r))
+			return n, r.decodeErr()
 		case decoderResultNeedsMoreOutput:
 			if n == 0 {
 				return 0, io.ErrShortBuffer
@@ -79,7 +447,7 @@ func (r *Reader) Read(p []byte) (n int, err error) {
 		}
 
 		// Top off the buffer.
-		encN, err := r.src.Read(r.buf)
+		encN, err := r.readInput()
 		if encN == 0 {
 			// Not enough data to complete decoding.
 			if err == io.EOF {
@@ -87,6 +455,177 @@ func (r *Reader) Read(p []byte) (n int, err error) {
 			}
 			return 0, err
 		}
-		r.in = r.buf[:encN]
+	}
+}
+
+// WriteTo implements io.WriterTo. It decompresses the rest of the stream
+// and writes it to w straight from the Reader's sliding window, without
+// copying it through an intermediate buffer. It returns the number of bytes
+// written and the first error encountered, or nil once the stream is
+// complete.
+func (r *Reader) WriteTo(w io.Writer) (n int64, err error) {
+	emptyReads := 0
+	for {
+		var availableOut uint
+		inLen := uint(len(r.in))
+		inRemaining := inLen
+		result := decoderDecompressStream(r, &inRemaining, &r.in, &availableOut, nil)
+		r.total_in += uint64(inLen - inRemaining)
+
+		for {
+			var size uint
+			out := decoderTakeOutput(r, &size)
+			if size == 0 {
+				break
+			}
+			m, err := w.Write(out)
+			n += int64(m)
+			if err != nil {
+				return n, err
+			}
+		}
+
+		switch result {
+		case decoderResultSuccess:
+			if r.multistream {
+				err := r.NextStream()
+				if err == io.EOF {
+					return n, nil
+				}
+				if err != nil {
+					return n, err
+				}
+				continue
+			}
+			if err := r.streamEnded(); err != io.EOF {
+				return n, err
+			}
+			return n, nil
+		case decoderResultError:
+			return n, r.decodeErr()
+		case decoderResultNeedsMoreOutput:
+			continue
+		case decoderNeedsMoreInput:
+		}
+
+		if len(r.in) != 0 {
+			return n, errInvalidState
+		}
+		encN, readErr := r.readInput()
+		if encN == 0 {
+			if readErr == io.EOF {
+				if r.total_in == 0 {
+					// Empty input, for which Read returns io.EOF.
+					return n, nil
+				}
+				return n, io.ErrUnexpectedEOF
+			}
+			if readErr != nil {
+				return n, readErr
+			}
+			if emptyReads++; emptyReads >= 100 {
+				return n, io.ErrNoProgress
+			}
+		} else {
+			emptyReads = 0
+		}
+	}
+}
+
+// ReaderStats reports on the work a Reader has done since it was created or
+// last reset.
+type ReaderStats struct {
+	// BytesIn is the number of compressed bytes consumed by the decoder.
+	// Input that the Reader has read from its source but not decoded yet is
+	// not counted.
+	BytesIn int64
+	// BytesOut is the number of decompressed bytes returned by Read.
+	BytesOut int64
+	// Metablocks is the number of metablocks decoded completely, including
+	// metadata and empty ones.
+	Metablocks int64
+	// WindowSize is the size in bytes of the sliding window declared by the
+	// stream, or 0 if the stream header has not been decoded yet.
+	WindowSize int64
+	// MetadataBytes is the total size of the metadata block payloads
+	// decoded so far.
+	MetadataBytes int64
+}
+
+// Stats returns statistics about the current stream.
+func (r *Reader) Stats() ReaderStats {
+	stats := ReaderStats{
+		BytesIn:       int64(r.total_in),
+		BytesOut:      int64(r.partial_pos_out),
+		Metablocks:    int64(r.metablock_count),
+		MetadataBytes: int64(r.metadata_bytes),
+	}
+	if r.window_bits != 0 {
+		stats.WindowSize = 1 << r.window_bits
+	}
+	return stats
+}
+
+// decodeErr returns the error for a stream that the decoder has rejected.
+func (r *Reader) decodeErr() error {
+	e := &DecodeError{
+		Code:         ErrorCode(decoderGetErrorCode(r)),
+		Offset:       int64(r.error_position >> 3),
+		Bit:          int(r.error_position & 7),
+		OutputOffset: int64(r.error_output_position),
+		Metablock:    int(r.metablock_count),
+		err:          ErrCorrupt,
+	}
+	switch e.Code {
+	case ErrorOutputLimit:
+		e.err = ErrOutputLimit
+	case ErrorWindowLimit, ErrorAllocContextModes, ErrorAllocTreeGroups, ErrorAllocContextMap, ErrorAllocRingBuffer1, ErrorAllocRingBuffer2, ErrorAllocBlockTypeTrees, ErrorAllocMetadata:
+		e.err = ErrMemoryLimit
+	case ErrorInvalidArguments, ErrorUnreachable:
+		e.err = errInvalidState
+	case ErrorFormatWindowBits:
+		if !r.options.LargeWindow {
+			// Without the extension, the only invalid window bits are the
+			// 0x11 signature of "Large Window Brotli".
+			e.err = errLargeWindow
+		}
+	}
+	return e
+}
+
+// Decode decompresses src, which must hold exactly one complete stream, and
+// appends the result to dst, returning the extended slice. It is equivalent
+// to reading all of src through a Reader, but decodes straight into dst.
+// Streams produced with WriterOptions.LargeWindow are rejected.
+func Decode(dst, src []byte) ([]byte, error) {
+	r := new(Reader)
+	if !decoderStateInit(r) {
+		return dst, errInvalidState
+	}
+	availableIn := uint(len(src))
+	nextIn := src
+	for {
+		if len(dst) == cap(dst) {
+			dst = append(dst, 0)[:len(dst)]
+		}
+		out := dst[len(dst):cap(dst)]
+		availableOut := uint(len(out))
+		consumed := availableIn
+		result := decoderDecompressStream(r, &availableIn, &nextIn, &availableOut, &out)
+		r.total_in += uint64(consumed - availableIn)
+		dst = dst[:cap(dst)-int(availableOut)]
+
+		switch result {
+		case decoderResultSuccess:
+			if len(nextIn) > 0 {
+				return dst, errExcessiveInput
+			}
+			return dst, nil
+		case decoderResultError:
+			return dst, r.decodeErr()
+		case decoderResultNeedsMoreOutput:
+		case decoderNeedsMoreInput:
+			return dst, io.ErrUnexpectedEOF
+		}
 	}
 }
@@ -29,7 +29,7 @@ type ringBuffer struct {
 func ringBufferInit(rb *ringBuffer) {
 	rb.cur_size_ = 0
 	rb.pos_ = 0
-	rb.data_ = nil
+	rb.data_ = rb.data_[:0]
 	rb.buffer_ = nil
 }
 
@@ -45,13 +45,22 @@ func ringBufferSetup(params *encoderParams, rb *ringBuffer) {
 const kSlackForEightByteHashingEverywhere uint = 7
 
 /* Allocates or re-allocates data_ to the given length + plus some slack
-   region before and after. Fills the slack regions with zeros. */
+   region before and after. Fills the slack regions with zeros.
+   If the capacity of data_ is large enough, it is reused; the bytes past
+   the previous length are cleared so that the result is the same as with
+   a fresh allocation. */
 func ringBufferInitBuffer(buflen uint32, rb *ringBuffer) {
-	var new_data []byte = make([]byte, (2 + uint(buflen) + kSlackForEightByteHashingEverywhere))
+	var size uint = 2 + uint(buflen) + kSlackForEightByteHashingEverywhere
+	var new_data []byte
 	var i uint
-	if rb.data_ != nil {
-		copy(new_data, rb.data_[:2+rb.cur_size_+uint32(kSlackForEightByteHashingEverywhere)])
-		rb.data_ = nil
+	if uint(cap(rb.data_)) >= size {
+		new_data = rb.data_[:size]
+		for j := len(rb.data_); j < len(new_data); j++ {
+			new_data[j] = 0
+		}
+	} else {
+		new_data = make([]byte, size)
+		copy(new_data, rb.data_)
 	}
 
 	rb.data_ = new_data
@@ -90,14 +99,7 @@ func ringBufferWrite(bytes []byte, n uint, rb *ringBuffer) {
 	}
 
 	if rb.cur_size_ < rb.total_size_ {
-		/* Lazily allocate the full buffer. */
-		ringBufferInitBuffer(rb.total_size_, rb)
-
-		/* Initialize the last two bytes to zero, so that we don't have to worry
-		   later when we copy the last two bytes to the first two positions. */
-		rb.buffer_[rb.size_-2] = 0
-
-		rb.buffer_[rb.size_-1] = 0
+		ringBufferInitFullBuffer(rb)
 	}
 	{
 		var masked_pos uint = uint(rb.pos_ & rb.mask_)
@@ -118,15 +120,63 @@ func ringBufferWrite(bytes []byte, n uint, rb *ringBuffer) {
 			copy(rb.buffer_, bytes[rb.size_-uint32(masked_pos):][:uint32(n)-(rb.size_-uint32(masked_pos))])
 		}
 	}
-	{
-		var not_first_lap bool = rb.pos_&(1<<31) != 0
-		var rb_pos_mask uint32 = (1 << 31) - 1
-		rb.data_[0] = rb.buffer_[rb.size_-2]
-		rb.data_[1] = rb.buffer_[rb.size_-1]
-		rb.pos_ = (rb.pos_ & rb_pos_mask) + uint32(uint32(n)&rb_pos_mask)
-		if not_first_lap {
-			/* Wrap, but preserve not-a-first-lap feature. */
-			rb.pos_ |= 1 << 31
-		}
+	ringBufferAdvance(n, rb)
+}
+
+/* Lazily allocates the full buffer. */
+func ringBufferInitFullBuffer(rb *ringBuffer) {
+	ringBufferInitBuffer(rb.total_size_, rb)
+
+	/* Initialize the last two bytes to zero, so that we don't have to worry
+	   later when we copy the last two bytes to the first two positions. */
+	rb.buffer_[rb.size_-2] = 0
+
+	rb.buffer_[rb.size_-1] = 0
+}
+
+func ringBufferAdvance(n uint, rb *ringBuffer) {
+	var not_first_lap bool = rb.pos_&(1<<31) != 0
+	var rb_pos_mask uint32 = (1 << 31) - 1
+	rb.data_[0] = rb.buffer_[rb.size_-2]
+	rb.data_[1] = rb.buffer_[rb.size_-1]
+	rb.pos_ = (rb.pos_ & rb_pos_mask) + uint32(uint32(n)&rb_pos_mask)
+	if not_first_lap {
+		/* Wrap, but preserve not-a-first-lap feature. */
+		rb.pos_ |= 1 << 31
+	}
+}
+
+/* Returns the part of the ring buffer that the next bytes pushed into it go
+   to: at most |n| bytes, and never past the end of the buffer. Bytes stored
+   there must then be pushed with ringBufferCommit instead of
+   ringBufferWrite, which saves copying them in from another buffer. */
+func ringBufferWriteSpace(n uint, rb *ringBuffer) []byte {
+	if rb.cur_size_ < rb.total_size_ && uint(rb.pos_)+n <= uint(rb.tail_size_) {
+		/* As in ringBufferWrite, the first block does not need the whole
+		   ring-buffer: it is read into a buffer just big enough for it, which
+		   ringBufferCommit trims to the bytes actually stored. */
+		ringBufferInitBuffer(rb.pos_+uint32(n), rb)
+		return rb.buffer_[rb.pos_:][:n]
 	}
+
+	if rb.cur_size_ < rb.total_size_ {
+		ringBufferInitFullBuffer(rb)
+	}
+
+	var masked_pos uint = uint(rb.pos_ & rb.mask_)
+	return rb.buffer_[masked_pos:brotli_min_size_t(masked_pos+n, uint(rb.size_))]
+}
+
+/* Pushes |n| bytes that have been stored in the slice returned by
+   ringBufferWriteSpace. */
+func ringBufferCommit(n uint, rb *ringBuffer) {
+	if rb.cur_size_ < rb.total_size_ {
+		rb.pos_ += uint32(n)
+		ringBufferInitBuffer(rb.pos_, rb)
+		return
+	}
+
+	var masked_pos uint = uint(rb.pos_ & rb.mask_)
+	ringBufferWriteTail(rb.buffer_[masked_pos:], n, rb)
+	ringBufferAdvance(n, rb)
 }
@@ -0,0 +1,467 @@
+package brotli
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// A seekable stream is an ordinary Brotli stream whose data is cut into
+// frames that are compressed independently: their backward references do
+// not reach before the start of the frame, except into the dictionaries, so
+// each frame can be decoded without the ones before it. The frames are
+// compressed the way a Writer compresses chunks in parallel mode, and each
+// ends on a byte boundary.
+//
+// The seek table comes after the last frame, in a metadata block that
+// decoders skip, right before the empty metablock that ends the stream. Its
+// payload is an entry for every frame, followed by a footer, with all
+// integers in little-endian order:
+//
+//	entry:  compressed size (4 bytes), decompressed size (4 bytes),
+//	        last two bytes before the frame (2 bytes)
+//	footer: number of frames (4 bytes), offset of the first frame in the
+//	        stream (4 bytes), magic number (4 bytes)
+//
+// The last two bytes before a frame give the context of its first literals.
+const (
+	seekTableMagic   = 0x4b535242 // "BRSK"
+	seekEntrySize    = 10
+	seekFooterSize   = 12
+	defaultFrameSize = 1 << 20
+	maxFrameSize     = 1 << 30
+
+	// maxStreamHeaderSize is the most bytes the stream header and the
+	// padding that puts the first frame on a byte boundary can take.
+	maxStreamHeaderSize = 8
+)
+
+// ErrNoSeekTable is returned by NewSeekableReader for a stream that does not
+// end with a seek table, such as one that was not written by a
+// SeekableWriter.
+var ErrNoSeekTable = errors.New("brotli: stream has no seek table")
+
+var (
+	errSeekTable     = fmt.Errorf("%w: invalid seek table", ErrCorrupt)
+	errSeekFrame     = fmt.Errorf("%w: frame does not match the seek table", ErrCorrupt)
+	errSeekTableSize = errors.New("brotli: too many frames for the seek table")
+	errSeekWhence    = errors.New("brotli: invalid whence")
+	errSeekNegative  = errors.New("brotli: negative position")
+)
+
+// seekFrame is an entry of the seek table.
+type seekFrame struct {
+	offset         int64 // position of the frame in the compressed stream
+	compressedSize int
+	start          int64 // position of the frame in the decompressed data
+	size           int
+	prev           [2]byte
+}
+
+// SeekableWriter compresses data into a seekable stream, which any decoder
+// can read as a whole, and which a SeekableReader can also read at random
+// positions, decoding only the frames it needs.
+type SeekableWriter struct {
+	w      *Writer
+	frames []seekFrame
+}
+
+// NewSeekableWriter returns a SeekableWriter that writes to dst. The input
+// is cut into frames of options.ChunkSize bytes, 1 MiB if it is not
+// positive, and at most 1 GiB. Frames are compressed in parallel, as by a
+// Writer with the same options. Smaller frames make random access cheaper,
+// since a whole frame is decoded to read any part of it, but compress
+// worse, as matches cannot reach into earlier frames.
+func NewSeekableWriter(dst io.Writer, options WriterOptions) *SeekableWriter {
+	if options.ChunkSize <= 0 {
+		options.ChunkSize = defaultFrameSize
+	} else if options.ChunkSize > maxFrameSize {
+		options.ChunkSize = maxFrameSize
+	}
+	w := &SeekableWriter{w: &Writer{options: options}}
+	w.Reset(dst)
+	return w
+}
+
+// Reset discards the SeekableWriter's state and makes it equivalent to the
+// result of NewSeekableWriter with the original options, but writing to dst
+// instead.
+func (w *SeekableWriter) Reset(dst io.Writer) {
+	w.w.Reset(dst)
+	w.frames = w.frames[:0]
+	w.w.parallel.chunkWritten = w.addFrame
+}
+
+func (w *SeekableWriter) addFrame(job *chunkJob, start int64) {
+	f := seekFrame{
+		offset:         start,
+		compressedSize: job.out.Len(),
+		start:          job.offset,
+		size:           job.size,
+	}
+	copy(f.prev[2-len(job.prev):], job.prev)
+	w.frames = append(w.frames, f)
+}
+
+// Write implements io.Writer.
+func (w *SeekableWriter) Write(p []byte) (n int, err error) {
+	return w.w.Write(p)
+}
+
+// ReadFrom implements io.ReaderFrom.
+func (w *SeekableWriter) ReadFrom(src io.Reader) (n int64, err error) {
+	return w.w.ReadFrom(src)
+}
+
+// Flush ends the current frame early and outputs its encoded data. Each
+// Flush adds an entry to the seek table.
+func (w *SeekableWriter) Flush() error {
+	return w.w.Flush()
+}
+
+// Stats returns statistics about the current stream. BytesOut does not
+// include the seek table until Close.
+func (w *SeekableWriter) Stats() WriterStats {
+	return w.w.Stats()
+}
+
+// Close compresses the remaining data, then writes the seek table and ends
+// the stream.
+func (w *SeekableWriter) Close() error {
+	if w.w.dst == nil {
+		return errWriterClosed
+	}
+	if err := w.w.parallel.flush(w.w); err != nil {
+		return err
+	}
+	table, err := w.seekTable()
+	if err != nil {
+		return err
+	}
+	if err := w.w.WriteMetadata(table); err != nil {
+		return err
+	}
+	return w.w.Close()
+}
+
+func (w *SeekableWriter) seekTable() ([]byte, error) {
+	if len(w.frames)*seekEntrySize+seekFooterSize > maxMetadataBlockSize {
+		return nil, errSeekTableSize
+	}
+	var dataStart int64
+	if len(w.frames) > 0 {
+		dataStart = w.frames[0].offset
+	}
+	table := make([]byte, len(w.frames)*seekEntrySize+seekFooterSize)
+	for i, f := range w.frames {
+		entry := table[i*seekEntrySize:]
+		binary.LittleEndian.PutUint32(entry[0:], uint32(f.compressedSize))
+		binary.LittleEndian.PutUint32(entry[4:], uint32(f.size))
+		copy(entry[8:10], f.prev[:])
+	}
+	footer := table[len(w.frames)*seekEntrySize:]
+	binary.LittleEndian.PutUint32(footer[0:], uint32(len(w.frames)))
+	binary.LittleEndian.PutUint32(footer[4:], uint32(dataStart))
+	binary.LittleEndian.PutUint32(footer[8:], seekTableMagic)
+	return table, nil
+}
+
+// SeekableReader reads the decompressed data of a stream written by a
+// SeekableWriter at random positions. It implements io.ReaderAt, io.Reader
+// and io.Seeker. Reading decodes the frames that hold the requested data,
+// and keeps the last one decoded, so that reading a frame piece by piece
+// decodes it once.
+//
+// ReadAt may be called concurrently, but the calls are serialized. Read and
+// Seek share a position, and may not be called concurrently.
+type SeekableReader struct {
+	src         io.ReaderAt
+	options     ReaderOptions
+	frames      []seekFrame
+	size        int64
+	windowBits  uint32
+	largeWindow bool
+	pos         int64 // for Read and Seek
+
+	mu    sync.Mutex
+	dec   Reader
+	frame int // index of the frame decoded into out, or -1
+	in    []byte
+	out   []byte
+}
+
+// NewSeekableReader reads the seek table of the stream of size bytes in src,
+// and returns a SeekableReader for it. It returns ErrNoSeekTable if the
+// stream does not have one. Of the options, MaxDecodedSize, MetadataCallback
+// and StopAtStreamEnd are ignored. MemoryLimit, if set, bounds the memory
+// of the decoder together with the buffers of the frame it keeps;
+// NewSeekableReader returns ErrMemoryLimit if the largest frame does not fit.
+func NewSeekableReader(src io.ReaderAt, size int64, options ReaderOptions) (*SeekableReader, error) {
+	options.MaxDecodedSize = 0
+	options.MetadataCallback = nil
+	options.StopAtStreamEnd = false
+	r := &SeekableReader{src: src, options: options, frame: -1}
+	if err := r.readSeekTable(size); err != nil {
+		return nil, err
+	}
+	if options.MemoryLimit > 0 && len(r.frames) > 0 {
+		limit, err := r.decoderMemoryLimit(options.MemoryLimit, 1)
+		if err != nil {
+			return nil, err
+		}
+		r.options.MemoryLimit = limit
+	}
+	return r, nil
+}
+
+// frameMemory is the memory held for the buffers of frame f: its compressed
+// and decompressed data.
+func frameMemory(f *seekFrame) int64 {
+	return int64(f.size) + int64(f.compressedSize)
+}
+
+// maxFrameMemory returns the largest frameMemory of the frames.
+func (r *SeekableReader) maxFrameMemory() int64 {
+	var max int64
+	for i := range r.frames {
+		if m := frameMemory(&r.frames[i]); m > max {
+			max = m
+		}
+	}
+	return max
+}
+
+// frameDecoderMemory is the most memory a decoder can hold for a frame: its
+// sliding window, twice while it grows, Huffman tables for 256 trees of each
+// kind, the block type trees, and context maps for 256 block types.
+func (r *SeekableReader) frameDecoderMemory() int64 {
+	var window int64 = int64(1)<<r.windowBits + int64(kRingBufferWriteAheadSlack)
+	var codes int64 = int64(kMaxHuffmanTableSize[(numLiteralSymbols+31)>>5]) + int64(kMaxHuffmanTableSize[(numCommandSymbols+31)>>5]) + int64(kMaxHuffmanTableSize[len(kMaxHuffmanTableSize)-1])
+	var blockTypeTrees int64 = 3 * (huffmanMaxSize258 + huffmanMaxSize26) * huffmanCodeSize
+	var contextMaps int64 = 256<<literalContextBits + 256<<distanceContextBits + 256
+	return 2*window + 256*(codes*huffmanCodeSize+3*sliceHeaderSize) + blockTypeTrees + contextMaps
+}
+
+// decoderMemoryLimit divides total between n decoders and the buffers of a
+// frame for each of them, and returns the memory limit of each decoder. It
+// returns ErrMemoryLimit if that leaves a decoder no room for its sliding
+// window.
+func (r *SeekableReader) decoderMemoryLimit(total int64, n int) (int64, error) {
+	limit := total/int64(n) - r.maxFrameMemory()
+	if max := r.frameDecoderMemory(); limit > max {
+		limit = max
+	}
+	if limit < int64(1)<<r.windowBits+int64(kRingBufferWriteAheadSlack) {
+		return 0, ErrMemoryLimit
+	}
+	return limit, nil
+}
+
+func (r *SeekableReader) readSeekTable(size int64) error {
+	var footer [seekFooterSize + 1]byte
+	if size < int64(len(footer)) {
+		return ErrNoSeekTable
+	}
+	if _, err := r.src.ReadAt(footer[:], size-int64(len(footer))); err != nil {
+		return err
+	}
+	// The footer ends the payload of a metadata block, which is followed by
+	// the empty last metablock.
+	if footer[seekFooterSize] != 3 || binary.LittleEndian.Uint32(footer[8:]) != seekTableMagic {
+		return ErrNoSeekTable
+	}
+	numFrames := int64(binary.LittleEndian.Uint32(footer[0:]))
+	dataStart := int64(binary.LittleEndian.Uint32(footer[4:]))
+	tableSize := numFrames * seekEntrySize
+	tableStart := size - int64(len(footer)) - tableSize
+	if tableSize > maxMetadataBlockSize || tableStart < dataStart || dataStart > maxStreamHeaderSize {
+		return errSeekTable
+	}
+
+	table := make([]byte, tableSize)
+	if _, err := r.src.ReadAt(table, tableStart); err != nil {
+		return err
+	}
+	r.frames = make([]seekFrame, numFrames)
+	offset, start := dataStart, int64(0)
+	for i := range r.frames {
+		entry := table[i*seekEntrySize:]
+		f := &r.frames[i]
+		f.offset = offset
+		f.compressedSize = int(binary.LittleEndian.Uint32(entry[0:]))
+		f.start = start
+		f.size = int(binary.LittleEndian.Uint32(entry[4:]))
+		copy(f.prev[:], entry[8:10])
+		if f.compressedSize == 0 || f.size == 0 || f.size > maxFrameSize {
+			return errSeekTable
+		}
+		offset += int64(f.compressedSize)
+		start += int64(f.size)
+	}
+	// The metadata block header lies between the last frame and the table.
+	if offset >= tableStart {
+		return errSeekTable
+	}
+	r.size = start
+	if numFrames == 0 {
+		return nil
+	}
+	return r.readStreamHeader(dataStart)
+}
+
+// readStreamHeader decodes the stream header, which holds the window size
+// the frames are decoded with.
+func (r *SeekableReader) readStreamHeader(dataStart int64) error {
+	header := make([]byte, dataStart)
+	if _, err := r.src.ReadAt(header, 0); err != nil {
+		return err
+	}
+	d := &r.dec
+	d.options = r.options
+	d.initDecoder()
+	availableIn := uint(len(header))
+	nextIn := header
+	var availableOut uint
+	switch decoderDecompressStream(d, &availableIn, &nextIn, &availableOut, nil) {
+	case decoderResultError:
+		return d.decodeErr()
+	case decoderResultNeedsMoreInput:
+		if d.window_bits != 0 && d.partial_pos_out == 0 {
+			r.windowBits = d.window_bits
+			r.largeWindow = d.large_window
+			return nil
+		}
+	}
+	return errSeekTable
+}
+
+// Size returns the size of the decompressed data.
+func (r *SeekableReader) Size() int64 {
+	return r.size
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *SeekableReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errSeekNegative
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for n < len(p) {
+		if off >= r.size {
+			return n, io.EOF
+		}
+		i := sort.Search(len(r.frames), func(i int) bool {
+			return r.frames[i].start+int64(r.frames[i].size) > off
+		})
+		if err := r.loadFrame(i); err != nil {
+			return n, err
+		}
+		m := copy(p[n:], r.out[off-r.frames[i].start:])
+		n += m
+		off += int64(m)
+	}
+	return n, nil
+}
+
+// Read implements io.Reader.
+func (r *SeekableReader) Read(p []byte) (n int, err error) {
+	n, err = r.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker. Seeking is free: frames are only decoded when
+// they are read.
+func (r *SeekableReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errSeekWhence
+	}
+	if offset < 0 {
+		return 0, errSeekNegative
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// loadFrame decodes frame i into r.out, unless it is there already.
+func (r *SeekableReader) loadFrame(i int) error {
+	if r.frame == i {
+		return nil
+	}
+	r.frame = -1
+	f := &r.frames[i]
+	if cap(r.in) < f.compressedSize {
+		r.in = make([]byte, f.compressedSize)
+	}
+	if cap(r.out) < f.size {
+		r.out = make([]byte, f.size)
+	}
+	r.out = r.out[:f.size]
+	if err := r.decodeFrame(&r.dec, f, r.in[:f.compressedSize], r.out); err != nil {
+		return err
+	}
+	r.frame = i
+	return nil
+}
+
+// decodeFrame decodes frame f with the decoder d into out, which has the
+// size of the frame, reading its compressed data into in, which has the
+// compressed size. Frames can be decoded concurrently with different
+// decoders and buffers.
+func (r *SeekableReader) decodeFrame(d *Reader, f *seekFrame, in, out []byte) error {
+	if _, err := r.src.ReadAt(in, f.offset); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	d.options = r.options
+	decoderStateInit(d)
+	d.large_window = r.largeWindow
+	if code := decoderContinueStream(d, r.windowBits, uint64(f.start), f.prev[:]); code != decoderSuccess {
+		saveErrorCode(d, code)
+		return frameErr(d, f, 0)
+	}
+	base := int64(d.partial_pos_out)
+
+	availableIn := uint(len(in))
+	nextIn := in
+	availableOut := uint(len(out))
+	nextOut := out
+	result := decoderDecompressStream(d, &availableIn, &nextIn, &availableOut, &nextOut)
+	switch result {
+	case decoderResultError:
+		return frameErr(d, f, base)
+	case decoderResultNeedsMoreInput:
+		// Frames end between two metablocks, and do not end the stream.
+		if availableOut == 0 {
+			return nil
+		}
+	}
+	return errSeekFrame
+}
+
+// frameErr returns the error for a frame that the decoder d has rejected,
+// with positions in the whole stream rather than in the frame.
+func frameErr(d *Reader, f *seekFrame, base int64) error {
+	err := d.decodeErr()
+	if e, ok := err.(*DecodeError); ok {
+		e.Offset += f.offset
+		e.OutputOffset += f.start - base
+	}
+	return err
+}
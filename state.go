@@ -87,9 +87,31 @@ const (
 )
 
 type Reader struct {
-	src io.Reader
-	buf []byte // scratch space for reading from src
-	in  []byte // current chunk to decode; usually aliases buf
+	src      io.Reader
+	buf      []byte         // scratch space for reading from src
+	in       []byte         // current chunk to decode; usually aliases buf
+	peeker   bufferedReader // src, if it is one and options.StopAtStreamEnd is set
+	peeked   int            // length of the peeker's buffer that in was taken from
+	byteSrc  io.ByteReader  // src, if it is one and options.StopAtStreamEnd is set
+	options  ReaderOptions
+	metadata []byte // payload of the current metadata block
+
+	multistream bool // see Reader.Multistream
+
+	inspector *inspector // set by Inspect
+
+	/* Part of options.Dictionary still to be copied by the current command. */
+	compound_offset    int
+	compound_remaining int
+
+	/* Compressed bytes consumed from the caller, metablocks and metadata
+	   bytes decoded so far, and where the decoder failed: in bits of
+	   compressed input, and in bytes of output. */
+	total_in              uint64
+	metablock_count       uint
+	metadata_bytes        uint64
+	error_position        uint64
+	error_output_position uint64
 
 	state        int
 	loop_counter int
@@ -198,9 +220,9 @@ func decoderStateInit(s *Reader) bool {
 	s.rb_roundtrips = 0
 	s.partial_pos_out = 0
 
-	s.block_type_trees = nil
-	s.block_len_trees = nil
-	s.ringbuffer = nil
+	/* The ring buffer, the block type trees and the Huffman tree groups keep
+	   their backing arrays, so that a reset Reader can reuse them. */
+	s.ringbuffer = s.ringbuffer[:0]
 	s.ringbuffer_size = 0
 	s.new_ringbuffer_size = 0
 	s.ringbuffer_mask = 0
@@ -212,13 +234,21 @@ func decoderStateInit(s *Reader) bool {
 	s.dist_context_map_slice = nil
 
 	s.sub_loop_counter = 0
+	s.metadata = s.metadata[:0]
+	s.compound_offset = 0
+	s.compound_remaining = 0
+	s.total_in = 0
+	s.metablock_count = 0
+	s.metadata_bytes = 0
+	s.error_position = 0
+	s.error_output_position = 0
 
-	s.literal_hgroup.codes = nil
-	s.literal_hgroup.htrees = nil
-	s.insert_copy_hgroup.codes = nil
-	s.insert_copy_hgroup.htrees = nil
-	s.distance_hgroup.codes = nil
-	s.distance_hgroup.htrees = nil
+	s.literal_hgroup.codes = s.literal_hgroup.codes[:0]
+	s.literal_hgroup.htrees = s.literal_hgroup.htrees[:0]
+	s.insert_copy_hgroup.codes = s.insert_copy_hgroup.codes[:0]
+	s.insert_copy_hgroup.htrees = s.insert_copy_hgroup.htrees[:0]
+	s.distance_hgroup.codes = s.distance_hgroup.codes[:0]
+	s.distance_hgroup.htrees = s.distance_hgroup.htrees[:0]
 
 	s.is_last_metablock = 0
 	s.is_uncompressed = 0
@@ -233,8 +263,6 @@ func decoderStateInit(s *Reader) bool {
 	s.dist_rb[2] = 11
 	s.dist_rb[3] = 4
 	s.dist_rb_idx = 0
-	s.block_type_trees = nil
-	s.block_len_trees = nil
 
 	s.symbol_lists.storage = s.symbols_lists_array[:]
 	s.symbol_lists.offset = huffmanMaxCodeLength + 1
@@ -267,21 +295,21 @@ func decoderStateMetablockBegin(s *Reader) {
 	s.dist_context_map_slice = nil
 	s.dist_htree_index = 0
 	s.context_lookup = nil
-	s.literal_hgroup.codes = nil
-	s.literal_hgroup.htrees = nil
-	s.insert_copy_hgroup.codes = nil
-	s.insert_copy_hgroup.htrees = nil
-	s.distance_hgroup.codes = nil
-	s.distance_hgroup.htrees = nil
+	s.literal_hgroup.codes = s.literal_hgroup.codes[:0]
+	s.literal_hgroup.htrees = s.literal_hgroup.htrees[:0]
+	s.insert_copy_hgroup.codes = s.insert_copy_hgroup.codes[:0]
+	s.insert_copy_hgroup.htrees = s.insert_copy_hgroup.htrees[:0]
+	s.distance_hgroup.codes = s.distance_hgroup.codes[:0]
+	s.distance_hgroup.htrees = s.distance_hgroup.htrees[:0]
 }
 
 func decoderStateCleanupAfterMetablock(s *Reader) {
 	s.context_modes = nil
 	s.context_map = nil
 	s.dist_context_map = nil
-	s.literal_hgroup.htrees = nil
-	s.insert_copy_hgroup.htrees = nil
-	s.distance_hgroup.htrees = nil
+	s.literal_hgroup.htrees = s.literal_hgroup.htrees[:0]
+	s.insert_copy_hgroup.htrees = s.insert_copy_hgroup.htrees[:0]
+	s.distance_hgroup.htrees = s.distance_hgroup.htrees[:0]
 }
 
 func decoderHuffmanTreeGroupInit(s *Reader, group *huffmanTreeGroup, alphabet_size uint32, max_symbol uint32, ntrees uint32) bool {
@@ -289,7 +317,29 @@ func decoderHuffmanTreeGroupInit(s *Reader, group *huffmanTreeGroup, alphabet_si
 	group.alphabet_size = uint16(alphabet_size)
 	group.max_symbol = uint16(max_symbol)
 	group.num_htrees = uint16(ntrees)
-	group.htrees = make([][]huffmanCode, ntrees)
-	group.codes = make([]huffmanCode, (uint(ntrees) * max_table_size))
+	var codes_size uint = uint(ntrees) * max_table_size
+	{
+		var extra int = 0
+		if cap(group.htrees) < int(ntrees) {
+			extra += (int(ntrees) - cap(group.htrees)) * sliceHeaderSize
+		}
+		if uint(cap(group.codes)) < codes_size {
+			extra += (int(codes_size) - cap(group.codes)) * huffmanCodeSize
+		}
+		if !decoderCheckMemory(s, extra) {
+			return false
+		}
+	}
+
+	if cap(group.htrees) >= int(ntrees) {
+		group.htrees = group.htrees[:ntrees]
+	} else {
+		group.htrees = make([][]huffmanCode, ntrees)
+	}
+	if uint(cap(group.codes)) >= codes_size {
+		group.codes = group.codes[:codes_size]
+	} else {
+		group.codes = make([]huffmanCode, codes_size)
+	}
 	return !(group.codes == nil)
 }
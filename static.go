@@ -0,0 +1,265 @@
+package brotli
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PrecompressOptions configures Precompress.
+type PrecompressOptions struct {
+	// MinSize is the size of the smallest file worth compressing. 0 means
+	// 256.
+	MinSize int64
+	// MaxRatio is the largest size of a compressed file, relative to the
+	// original, for which the compressed file is written; compression does
+	// not pay off beyond it. 0 means 0.9.
+	MaxRatio float64
+	// Filter, if set, tells which files to compress, by their name in the
+	// file system. Files whose name ends in ".br" are never compressed.
+	Filter func(name string) bool
+}
+
+// Precompress compresses the files of fsys, such as an os.DirFS or an
+// embed.FS, for PrecompressedFileServer. For each file, it writes a Brotli
+// compressed copy to the directory dir, at the same path with ".br"
+// appended; dir can be the directory fsys reads. Files are compressed at
+// quality 11, with the smallest window that spans the whole file, up to the
+// largest window of standard Brotli.
+//
+// Files that are too small or do not compress well enough, according to
+// options, are skipped, and any compressed copy left over from an earlier
+// run is removed. Compressed copies are given the modification time of
+// their original, and are not compressed again while the original keeps
+// it, unless it is the zero time, as in an embed.FS.
+//
+// Precompress returns the names of the compressed files written, relative
+// to dir, and stops at the first error.
+func Precompress(dir string, fsys fs.FS, options PrecompressOptions) ([]string, error) {
+	if options.MinSize == 0 {
+		options.MinSize = 256
+	}
+	if options.MaxRatio == 0 {
+		options.MaxRatio = 0.9
+	}
+	var written []string
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || strings.HasSuffix(name, ".br") {
+			return nil
+		}
+		if options.Filter != nil && !options.Filter(name) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		sidecar := filepath.Join(dir, filepath.FromSlash(name)+".br")
+		if !info.ModTime().IsZero() {
+			if s, err := os.Stat(sidecar); err == nil && s.ModTime().Equal(info.ModTime()) {
+				return nil
+			}
+		}
+		ok, err := precompressFile(sidecar, fsys, name, info, &options)
+		if err != nil {
+			return err
+		}
+		if ok {
+			written = append(written, name+".br")
+		}
+		return nil
+	})
+	return written, err
+}
+
+// precompressFile writes the compressed copy of the file name to sidecar,
+// if it pays off, and reports whether it did.
+func precompressFile(sidecar string, fsys fs.FS, name string, info fs.FileInfo, options *PrecompressOptions) (bool, error) {
+	if info.Size() < options.MinSize {
+		return false, removeSidecar(sidecar)
+	}
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return false, err
+	}
+
+	var lgwin uint = minWindowBits
+	for lgwin < maxWindowBits && maxBackwardLimit(lgwin) < uint(len(data)) {
+		lgwin++
+	}
+	compressed, err := Encode(nil, data, WriterOptions{Quality: hqZopflificationQuality, LGWin: int(lgwin)})
+	if err != nil {
+		return false, err
+	}
+	if float64(len(compressed)) > options.MaxRatio*float64(len(data)) {
+		return false, removeSidecar(sidecar)
+	}
+
+	// Write to a temporary file first, so that the sidecar is never seen
+	// incomplete.
+	if err := os.MkdirAll(filepath.Dir(sidecar), 0755); err != nil {
+		return false, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(sidecar), ".precompress-*")
+	if err != nil {
+		return false, err
+	}
+	_, err = f.Write(compressed)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil && !info.ModTime().IsZero() {
+		err = os.Chtimes(f.Name(), info.ModTime(), info.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), sidecar)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return false, err
+	}
+	return true, nil
+}
+
+// removeSidecar removes a compressed copy that is no longer wanted.
+func removeSidecar(name string) error {
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// PrecompressedFileServer returns a handler that serves the files of root
+// like http.FileServer, but sends the compressed copy of a file written by
+// Precompress instead of the file itself to the clients that accept Brotli.
+// The compressed copy is sent with "Content-Encoding: br" and the
+// Content-Type of the original; responses for files that have a compressed
+// copy carry "Vary: Accept-Encoding" either way. Files are sent with a strong
+// ETag derived from their contents, with "-br" appended for the compressed
+// copies, and the handler answers conditional and range requests as
+// http.ServeContent does. Directories, including their index.html, are
+// served by http.FileServer.
+func PrecompressedFileServer(root http.FileSystem) http.Handler {
+	return &precompressedFileServer{root: root, fileServer: http.FileServer(root)}
+}
+
+type precompressedFileServer struct {
+	root       http.FileSystem
+	fileServer http.Handler
+	etags      sync.Map // file name to *etagEntry
+}
+
+// etagEntry is the ETag of the last version of a file that was served,
+// which the size and modification time identify.
+type etagEntry struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+func (s *precompressedFileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upath := r.URL.Path
+	if !strings.HasPrefix(upath, "/") {
+		upath = "/" + upath
+	}
+	name := path.Clean(upath)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead || strings.HasSuffix(upath, "/") || strings.HasSuffix(name, "/index.html") {
+		s.fileServer.ServeHTTP(w, r)
+		return
+	}
+
+	f, info := s.open(name)
+	if f == nil {
+		s.fileServer.ServeHTTP(w, r)
+		return
+	}
+	defer f.Close()
+
+	hdr := w.Header()
+	if sidecar, sidecarInfo := s.open(name + ".br"); sidecar != nil {
+		defer sidecar.Close()
+		hdr.Add("Vary", "Accept-Encoding")
+		if acceptEncodingQuality(r.Header["Accept-Encoding"], "br") > 0 {
+			contentType := mime.TypeByExtension(path.Ext(name))
+			if contentType == "" {
+				var buf [512]byte
+				n, _ := io.ReadFull(f, buf[:])
+				contentType = http.DetectContentType(buf[:n])
+			}
+			hdr.Set("Content-Type", contentType)
+			hdr.Set("Content-Encoding", "br")
+			s.serve(w, r, name+".br", sidecar, sidecarInfo)
+			return
+		}
+	}
+	s.serve(w, r, name, f, info)
+}
+
+// open opens the regular file name, or returns nil.
+func (s *precompressedFileServer) open(name string) (http.File, fs.FileInfo) {
+	f, err := s.root.Open(name)
+	if err != nil {
+		return nil, nil
+	}
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		f.Close()
+		return nil, nil
+	}
+	return f, info
+}
+
+// serve sends the file name with http.ServeContent, setting its ETag.
+func (s *precompressedFileServer) serve(w http.ResponseWriter, r *http.Request, name string, f http.File, info fs.FileInfo) {
+	etag, err := s.etag(name, f, info)
+	if err != nil {
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Etag", etag)
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+// etag returns the ETag of the file name, hashing its contents the first
+// time it is served in its current version. Only the ETag of the last
+// version served is kept.
+func (s *precompressedFileServer) etag(name string, f http.File, info fs.FileInfo) (string, error) {
+	if v, ok := s.etags.Load(name); ok {
+		if e := v.(*etagEntry); e.size == info.Size() && e.modTime.Equal(info.ModTime()) {
+			return e.etag, nil
+		}
+	}
+	h := sha256.New()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	tag := hex.EncodeToString(h.Sum(nil)[:12])
+	if strings.HasSuffix(name, ".br") {
+		tag += "-br"
+	}
+	etag := `"` + tag + `"`
+	s.etags.Store(name, &etagEntry{size: info.Size(), modTime: info.ModTime(), etag: etag})
+	return etag, nil
+}
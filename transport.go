@@ -0,0 +1,205 @@
+package brotli
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// TransportOptions configures a Transport.
+type TransportOptions struct {
+	// ReaderOptions configures the decoding of response bodies. Set its
+	// MaxDecodedSize to make reading a body fail with ErrOutputLimit once it
+	// has produced that much data, and its MemoryLimit or MaxWindowBits to
+	// bound the memory of each decoder, so that a hostile server cannot
+	// exhaust the client's memory with a small response. The limits also
+	// apply to gzip bodies, except for the memory, which gzip bounds anyway.
+	ReaderOptions ReaderOptions
+	// RequestOptions, if set, makes the Transport compress request bodies
+	// with these options and send them with "Content-Encoding: br". Only
+	// use it with servers known to accept such requests. Requests that have
+	// a Content-Encoding already are sent as they are.
+	RequestOptions *WriterOptions
+}
+
+// Transport is an http.RoundTripper that asks servers for Brotli compressed
+// responses and decompresses them, the way http.Transport does for gzip.
+//
+// If a request has no Accept-Encoding header, is not a HEAD request and has
+// no Range header, the Transport sends it with "Accept-Encoding: br, gzip".
+// If the response is compressed with either, the Transport replaces its
+// Body with one that decompresses it, removes the Content-Encoding and
+// Content-Length headers, sets ContentLength to -1 and sets Uncompressed.
+// Requests that have an Accept-Encoding header are left to the caller, as
+// http.Transport does.
+type Transport struct {
+	base    http.RoundTripper
+	options TransportOptions
+	readers sync.Pool // idle Readers for response bodies
+	writers sync.Pool // idle Writers for request bodies
+}
+
+// NewTransport returns a Transport that makes its requests with base, or
+// with http.DefaultTransport if base is nil.
+func NewTransport(base http.RoundTripper, options TransportOptions) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &Transport{base: base, options: options}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	requested := req.Header.Get("Accept-Encoding") == "" && req.Header.Get("Range") == "" && req.Method != http.MethodHead
+	compressBody := t.options.RequestOptions != nil && req.Body != nil && req.Body != http.NoBody && req.Header.Get("Content-Encoding") == ""
+	if requested || compressBody {
+		// A RoundTripper must not modify the request.
+		req = req.Clone(req.Context())
+	}
+	if requested {
+		req.Header.Set("Accept-Encoding", "br, gzip")
+	}
+	if compressBody {
+		body, getBody := req.Body, req.GetBody
+		req.Body = t.compressRequestBody(body)
+		if getBody != nil {
+			req.GetBody = func() (io.ReadCloser, error) {
+				body, err := getBody()
+				if err != nil {
+					return nil, err
+				}
+				return t.compressRequestBody(body), nil
+			}
+		}
+		req.ContentLength = -1
+		req.Header.Del("Content-Length")
+		req.Header.Set("Content-Encoding", "br")
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || !requested {
+		return resp, err
+	}
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "br":
+		resp.Body = &brotliBody{t: t, body: resp.Body}
+	case "gzip":
+		resp.Body = &gzipBody{body: resp.Body, limit: t.options.ReaderOptions.MaxDecodedSize}
+	default:
+		return resp, nil
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return resp, nil
+}
+
+// compressRequestBody returns a body that reads body compressed. The
+// compression runs in a goroutine, which ends when the body has been read
+// or closed.
+func (t *Transport) compressRequestBody(body io.ReadCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		var w *Writer
+		if v := t.writers.Get(); v != nil {
+			w = v.(*Writer)
+			w.Reset(pw)
+		} else {
+			w = NewWriter(pw, *t.options.RequestOptions)
+		}
+		_, err := w.ReadFrom(body)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		t.writers.Put(w)
+		body.Close()
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// brotliBody decompresses a response body with a Reader from the pool of
+// its Transport, which it takes on the first Read and gives back on Close.
+type brotliBody struct {
+	t    *Transport
+	body io.ReadCloser
+
+	mu     sync.Mutex // held during Read, so that Close does not take r away
+	r      *Reader
+	closed bool
+}
+
+func (b *brotliBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return 0, errReaderClosed
+	}
+	if b.r == nil {
+		if v := b.t.readers.Get(); v != nil {
+			b.r = v.(*Reader)
+			b.r.Reset(b.body)
+		} else {
+			b.r = NewReaderOptions(b.body, b.t.options.ReaderOptions)
+		}
+	}
+	return b.r.Read(p)
+}
+
+func (b *brotliBody) Close() error {
+	// Closing the body first unblocks a Read in progress.
+	err := b.body.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed && b.r != nil {
+		b.r.Reset(nil)
+		b.t.readers.Put(b.r)
+		b.r = nil
+	}
+	b.closed = true
+	return err
+}
+
+// gzipBody decompresses a gzip response body, failing with ErrOutputLimit
+// after limit bytes if limit is positive.
+type gzipBody struct {
+	body  io.ReadCloser
+	limit int64
+
+	zr  *gzip.Reader
+	n   int64
+	err error
+}
+
+func (b *gzipBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.zr == nil {
+		if b.zr, b.err = gzip.NewReader(b.body); b.err != nil {
+			return 0, b.err
+		}
+	}
+	if b.limit > 0 && int64(len(p)) > b.limit-b.n+1 {
+		// Read one byte past the limit to tell whether there is more.
+		p = p[:b.limit-b.n+1]
+	}
+	n, err := b.zr.Read(p)
+	b.n += int64(n)
+	if b.limit > 0 && b.n > b.limit {
+		n -= int(b.n - b.limit)
+		b.n = b.limit
+		err = ErrOutputLimit
+	}
+	if err != nil {
+		b.err = err
+	}
+	return n, err
+}
+
+func (b *gzipBody) Close() error {
+	return b.body.Close()
+}
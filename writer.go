@@ -1,7 +1,9 @@
 package brotli
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
 )
 
@@ -11,25 +13,199 @@ type WriterOptions struct {
 	// The higher the quality, the slower the compression. Range is 0 to 11.
 	Quality int
 	// LGWin is the base 2 logarithm of the sliding window size.
-	// Range is 10 to 24. 0 indicates automatic configuration based on Quality.
+	// Range is 10 to 24, or 10 to 30 if LargeWindow is set.
+	// 0 indicates automatic configuration based on Quality.
 	LGWin int
+	// LGBlock is the base 2 logarithm of the maximum input block size, which
+	// limits how much input goes into one metablock before it is compressed.
+	// Range is 16 to 24. 0 indicates automatic configuration based on Quality
+	// and LGWin. It is ignored by qualities below 4.
+	LGBlock int
+	// SizeHint is the expected total size of the input, if it is known in
+	// advance. It lets the encoder pick its hasher and context modeling for
+	// the whole stream before the first Write, instead of guessing from the
+	// data buffered so far. If LGWin is 0, it also selects a window no larger
+	// than needed for the input. 0 means the size is unknown.
+	SizeHint int
+	// LargeWindow enables the "Large Window Brotli" extension, which allows
+	// windows of up to 1 GiB. Its output is not standard Brotli: it can only
+	// be decoded by a Reader with ReaderOptions.LargeWindow set, or by other
+	// decoders that support the extension. Qualities 0 to 2 never use it.
+	LargeWindow bool
+	// Mode tells the encoder what kind of data it is compressing, so that it
+	// can tune its choices for it. The zero value is ModeGeneric.
+	Mode Mode
+	// Dictionary is a custom dictionary: data that the input is likely to
+	// share substrings with, such as a sample message. Backward references
+	// can reach into it as if it came right before the sliding window, which
+	// can shrink small inputs considerably. The stream can only be decoded by
+	// a Reader with the same ReaderOptions.Dictionary. Qualities 0 and 1 do
+	// not use it.
+	Dictionary []byte
+	// MetablockTrace, if set, is called with a description of every
+	// metablock that carries data, as soon as the encoder has produced it.
+	// It shows the decisions the encoder made, for tuning the options.
+	MetablockTrace func(MetablockInfo)
+	// ChunkSize, if positive, turns on parallel compression: the input is
+	// cut into chunks of ChunkSize bytes, which are compressed concurrently
+	// and spliced into a single stream. Each chunk is compressed as if it
+	// started a new stream, so its matches cannot reach back into the
+	// earlier chunks. The output is therefore larger than that of a
+	// sequential Writer, by more the smaller the chunks are compared to the
+	// window and the further apart the repetitions in the data are, in
+	// exchange for compression up to Concurrency times faster. As a rough guide, for a few MiB of Go
+	// source at quality 5 with a 4 MiB window, 4 MiB chunks made the output
+	// 3% larger and 1 MiB chunks 25% larger; qualities 0 and 1, whose
+	// matches do not reach far anyway, lose almost nothing with chunks of
+	// 1 MiB. Flush and WriteMetadata end the current chunk early.
+	// The output only depends on the options, the data and the calls to
+	// Flush and WriteMetadata; it is the same whatever Concurrency and
+	// GOMAXPROCS are.
+	ChunkSize int
+	// Concurrency is the number of chunks compressed at the same time in
+	// parallel mode. Each needs an encoder with its own window, and a chunk's
+	// compressed output is held until the earlier chunks have been written.
+	// 0 means runtime.GOMAXPROCS(0).
+	Concurrency int
 }
 
+// MetablockInfo describes a metablock written by a Writer, for
+// WriterOptions.MetablockTrace.
+type MetablockInfo struct {
+	// Offset is the position of the metablock's first byte in the
+	// uncompressed input.
+	Offset int64
+	// InputSize is the number of uncompressed bytes in the metablock.
+	InputSize int
+	// OutputBits is the size of the encoded metablock, header included.
+	OutputBits int
+	// Uncompressed reports that the data was stored as is, because
+	// compressing it would not have made it smaller.
+	Uncompressed bool
+	// Commands and Literals are the number of insert-and-copy commands and
+	// of literal bytes found by the LZ77 search. Quality 0 does not count
+	// them.
+	Commands int
+	Literals int
+	// ContextMode is the context mode of the literals. Only qualities 10
+	// and 11 choose it from the data; qualities 4 to 9 use ContextUTF8.
+	// Qualities 0 to 3 use a single prefix code for the literals, whatever
+	// their context, and report ContextNone.
+	ContextMode ContextMode
+	// LiteralBlockTypes, CommandBlockTypes and DistanceBlockTypes are the
+	// number of block types the data was split into for each category, and
+	// LiteralHistograms, CommandHistograms and DistanceHistograms the number
+	// of prefix codes left after clustering. Only qualities 4 and above split
+	// blocks or use more than one prefix code per category. For a metablock
+	// stored uncompressed, they describe the encoding that was rejected, if
+	// any.
+	LiteralBlockTypes  int
+	CommandBlockTypes  int
+	DistanceBlockTypes int
+	LiteralHistograms  int
+	CommandHistograms  int
+	DistanceHistograms int
+	// DistancePostfixBits and DirectDistanceCodes are the distance
+	// parameters (NPOSTFIX and NDIRECT in RFC 7932) used for the metablock.
+	DistancePostfixBits int
+	DirectDistanceCodes int
+}
+
+// ContextMode is the way literals are split into contexts, each of which
+// can have its own prefix code.
+type ContextMode int
+
+const (
+	// ContextNone reports that the literals are not split into contexts.
+	ContextNone ContextMode = -1
+	// ContextLSB6 uses the 6 least significant bits of the previous byte.
+	ContextLSB6 ContextMode = contextLSB6
+	// ContextMSB6 uses the 6 most significant bits of the previous byte.
+	ContextMSB6 ContextMode = contextMSB6
+	// ContextUTF8 uses the kind of character the previous two bytes are
+	// part of, which suits UTF-8 text.
+	ContextUTF8 ContextMode = contextUTF8
+	// ContextSigned uses the magnitude of the previous two bytes taken as
+	// signed integers, which suits binary data such as samples.
+	ContextSigned ContextMode = contextSigned
+)
+
+func (m ContextMode) String() string {
+	switch m {
+	case ContextNone:
+		return "None"
+	case ContextLSB6:
+		return "LSB6"
+	case ContextMSB6:
+		return "MSB6"
+	case ContextUTF8:
+		return "UTF8"
+	case ContextSigned:
+		return "Signed"
+	}
+	return fmt.Sprintf("ContextMode(%d)", int(m))
+}
+
+// Mode is a hint about the kind of data passed to a Writer.
+type Mode int
+
+const (
+	// ModeGeneric makes no assumptions about the input.
+	ModeGeneric Mode = modeGeneric
+	// ModeText is for UTF-8 formatted text.
+	ModeText Mode = modeText
+	// ModeFont is for font data, such as the tables of a TrueType font or a
+	// WOFF 2.0 font.
+	ModeFont Mode = modeFont
+)
+
 var (
 	errEncode       = errors.New("brotli: encode error")
 	errWriterClosed = errors.New("brotli: Writer is closed")
 )
 
+// maxMetadataBlockSize is the largest payload a single metadata metablock
+// can hold.
+const maxMetadataBlockSize = 1 << 24
+
 // NewWriter initializes new Writer instance.
 func NewWriter(dst io.Writer, options WriterOptions) *Writer {
-	w := new(Writer)
+	w := &Writer{options: options}
+	w.Reset(dst)
+	return w
+}
+
+// Reset discards the Writer's state and makes it equivalent to the result of
+// NewWriter with the original options, but writing to dst instead. Buffers
+// allocated for earlier streams are kept, so that reusing a Writer is cheaper
+// than creating a new one.
+func (w *Writer) Reset(dst io.Writer) {
 	encoderInitState(w)
-	w.params.quality = options.Quality
-	if options.LGWin > 0 {
-		w.params.lgwin = uint(options.LGWin)
+	w.params.quality = w.options.Quality
+	w.params.mode = int(w.options.Mode)
+	w.params.large_window = w.options.LargeWindow
+	if w.options.SizeHint > 0 {
+		w.params.size_hint = uint(w.options.SizeHint)
 	}
+	if w.options.LGWin > 0 {
+		w.params.lgwin = uint(w.options.LGWin)
+	} else if w.params.size_hint > 0 {
+		w.params.lgwin = computeLgWinForSize(w.params.size_hint)
+	}
+	if w.options.LGBlock > 0 {
+		w.params.lgblock = w.options.LGBlock
+	}
+	if len(w.options.Dictionary) > 0 {
+		if w.dictionary.source == nil {
+			prepareDictionary(&w.dictionary, w.options.Dictionary)
+		}
+		w.params.dictionary.compound = w.dictionary
+	}
+	w.metablocks_.tracing = w.options.MetablockTrace != nil
 	w.dst = dst
-	return w
+	if w.options.ChunkSize > 0 {
+		w.resetParallel()
+	}
 }
 
 func (w *Writer) writeChunk(p []byte, op int) (n int, err error) {
@@ -44,6 +220,9 @@ func (w *Writer) writeChunk(p []byte, op int) (n int, err error) {
 		bytesConsumed := len(p) - int(availableIn)
 		p = p[bytesConsumed:]
 		n += bytesConsumed
+		if op != operationEmitMetadata {
+			w.bytes_in_ += uint64(bytesConsumed)
+		}
 		if !success {
 			return n, errEncode
 		}
@@ -56,7 +235,10 @@ func (w *Writer) writeChunk(p []byte, op int) (n int, err error) {
 				return n, err
 			}
 		}
-		if len(p) == 0 {
+		// A metadata block is only complete once the encoder has returned to
+		// normal processing, which takes one more call after its payload
+		// has been consumed.
+		if len(p) == 0 && (op != operationEmitMetadata || w.stream_state_ == streamProcessing) {
 			return n, nil
 		}
 	}
@@ -67,20 +249,246 @@ func (w *Writer) writeChunk(p []byte, op int) (n int, err error) {
 // not yet complete until after Close.
 // Flush has a negative impact on compression.
 func (w *Writer) Flush() error {
-	_, err := w.writeChunk(nil, operationFlush)
+	var err error
+	if w.parallel != nil {
+		if w.dst == nil {
+			return errWriterClosed
+		}
+		if err = w.parallel.flush(w); err == nil {
+			err = w.parallel.writeHeader(w)
+		}
+	} else {
+		_, err = w.writeChunk(nil, operationFlush)
+	}
+	if err == nil {
+		w.flushes_++
+	}
 	return err
 }
 
 // Close flushes remaining data to the decorated writer.
 func (w *Writer) Close() error {
+	if w.parallel != nil {
+		if w.dst == nil {
+			return errWriterClosed
+		}
+		err := w.parallel.close(w)
+		w.dst = nil
+		return err
+	}
+
 	// If stream is already closed, it is reported by `writeChunk`.
 	_, err := w.writeChunk(nil, operationFinish)
 	w.dst = nil
 	return err
 }
 
+// WriterStats reports on the work a Writer has done since it was created or
+// last reset.
+type WriterStats struct {
+	// BytesIn is the number of uncompressed bytes accepted by Write,
+	// not counting metadata.
+	BytesIn int64
+	// BytesOut is the number of compressed bytes produced, including those
+	// of metadata blocks.
+	BytesOut int64
+	// Metablocks is the number of metablocks that carry data.
+	// Metadata blocks, the empty blocks written to pad a Flush to a byte
+	// boundary and the empty block that may end the stream are not counted.
+	Metablocks int64
+	// CompressedMetablocks and UncompressedMetablocks split Metablocks by
+	// how their data is stored. The encoder stores a metablock uncompressed
+	// when compressing it would not make it smaller.
+	CompressedMetablocks   int64
+	UncompressedMetablocks int64
+	// Flushes is the number of successful calls to Flush.
+	Flushes int64
+}
+
+// Stats returns statistics about the current stream.
+func (w *Writer) Stats() WriterStats {
+	return WriterStats{
+		BytesIn:                int64(w.bytes_in_),
+		BytesOut:               int64(w.total_out_),
+		Metablocks:             int64(w.metablocks_.compressed + w.metablocks_.uncompressed),
+		CompressedMetablocks:   int64(w.metablocks_.compressed),
+		UncompressedMetablocks: int64(w.metablocks_.uncompressed),
+		Flushes:                int64(w.flushes_),
+	}
+}
+
+// Encode compresses src and appends the result to dst, returning the
+// extended slice. It produces a complete stream in one call, without the
+// io.Writer plumbing of Writer. Since the size of the input is known, it is
+// used for options.SizeHint unless that is set, which also picks the window
+// size when options.LGWin is 0. If compression would make the data larger,
+// Encode stores it uncompressed instead, so the result never grows dst by
+// more than MaxCompressedSize(len(src)) bytes.
+// If options.ChunkSize is set, src is compressed in parallel, as by a Writer.
+func Encode(dst, src []byte, options WriterOptions) ([]byte, error) {
+	if len(src) == 0 {
+		return makeUncompressedStream(dst, nil), nil
+	}
+	if options.SizeHint == 0 {
+		options.SizeHint = len(src)
+	}
+	if options.ChunkSize > 0 {
+		return encodeParallel(dst, src, options)
+	}
+	w := &Writer{options: options}
+	w.Reset(nil)
+	if !ensureInitialized(w) {
+		return dst, errEncode
+	}
+
+	// Allocate storage for the largest metablock this input can produce
+	// once, instead of growing it block by block.
+	blockSize := maxMetablockSize(&w.params)
+	if uint(len(src)) < blockSize {
+		blockSize = uint(len(src))
+	}
+	getBrotliStorage(w, 2*blockSize+503)
+
+	start := len(dst)
+	maxSize := MaxCompressedSize(len(src))
+	availableIn := uint(len(src))
+	nextIn := src
+	for w.stream_state_ != streamFinished || encoderHasMoreOutput(w) {
+		if !encoderCompressStream(w, operationFinish, &availableIn, &nextIn) {
+			return dst[:start], errEncode
+		}
+		dst = append(dst, encoderTakeOutput(w)...)
+		if len(dst)-start > maxSize {
+			return makeUncompressedStream(dst[:start], src), nil
+		}
+	}
+	return dst, nil
+}
+
+func encodeParallel(dst, src []byte, options WriterOptions) ([]byte, error) {
+	start := len(dst)
+	buf := bytes.NewBuffer(dst)
+	w := NewWriter(buf, options)
+	if _, err := w.Write(src); err != nil {
+		return dst[:start], err
+	}
+	if err := w.Close(); err != nil {
+		return dst[:start], err
+	}
+	if buf.Len()-start > MaxCompressedSize(len(src)) {
+		return makeUncompressedStream(dst[:start], src), nil
+	}
+	return buf.Bytes(), nil
+}
+
+// MaxCompressedSize returns an upper bound on the size of the output of
+// Encode for an input of n bytes, whatever the options. It returns 0 if the
+// bound does not fit in an int.
+func MaxCompressedSize(n int) int {
+	// Stream header and empty metadata block, then an uncompressed
+	// metablock header for every 16 KiB of input, then an empty last
+	// metablock.
+	if n == 0 {
+		return 2
+	}
+	numLargeBlocks := n >> 14
+	overhead := 2 + 4*numLargeBlocks + 3 + 1
+	result := n + overhead
+	if result < n {
+		return 0
+	}
+	return result
+}
+
+// WriteMetadata writes p to the stream as metadata. Decoders skip metadata,
+// so it does not change the decompressed output; it can carry application
+// data alongside it, which a Reader hands to
+// ReaderOptions.MetadataCallback. Data passed to Write before WriteMetadata
+// is compressed first, so the metadata marks that position in the stream.
+// Payloads larger than 16 MiB are split over several metadata blocks. An
+// empty p writes an empty metadata block, which pads the output to a byte
+// boundary.
+func (w *Writer) WriteMetadata(p []byte) error {
+	if w.parallel != nil && w.dst != nil {
+		if err := w.parallel.flush(w); err != nil {
+			return err
+		}
+	}
+	for {
+		chunk := p
+		if len(chunk) > maxMetadataBlockSize {
+			chunk = chunk[:maxMetadataBlockSize]
+		}
+		if _, err := w.writeChunk(chunk, operationEmitMetadata); err != nil {
+			return err
+		}
+		p = p[len(chunk):]
+		if len(p) == 0 {
+			return nil
+		}
+	}
+}
+
 // Write implements io.Writer. Flush or Close must be called to ensure that the
 // encoded bytes are actually flushed to the underlying Writer.
 func (w *Writer) Write(p []byte) (n int, err error) {
+	if w.parallel != nil {
+		if w.dst == nil {
+			return 0, errWriterClosed
+		}
+		return w.parallel.write(w, p)
+	}
 	return w.writeChunk(p, operationProcess)
 }
+
+// ReadFrom implements io.ReaderFrom. It compresses the data read from src
+// until EOF, and returns the number of bytes read. The data is read straight
+// into the encoder's sliding window, without being copied through an
+// intermediate buffer, except at qualities 0 and 1, which do not keep one,
+// and in parallel mode.
+// As with Write, Flush or Close must be called afterwards.
+func (w *Writer) ReadFrom(src io.Reader) (n int64, err error) {
+	if w.dst == nil {
+		return 0, errWriterClosed
+	}
+	if !ensureInitialized(w) {
+		return 0, errEncode
+	}
+
+	if w.parallel != nil || w.params.quality == fastOnePassCompressionQuality || w.params.quality == fastTwoPassCompressionQuality {
+		buf := make([]byte, readBufSize)
+		for {
+			m, readErr := src.Read(buf)
+			if m > 0 {
+				if _, err := w.Write(buf[:m]); err != nil {
+					return n, err
+				}
+				n += int64(m)
+			}
+			if readErr == io.EOF {
+				return n, nil
+			}
+			if readErr != nil {
+				return n, readErr
+			}
+		}
+	}
+
+	for {
+		if remainingInputBlockSize(w) == 0 {
+			// Compress the full input block to make room for more.
+			if _, err := w.writeChunk(nil, operationProcess); err != nil {
+				return n, err
+			}
+		}
+		m, readErr := readInputToRingBuffer(w, src)
+		n += int64(m)
+		w.bytes_in_ += uint64(m)
+		if readErr == io.EOF {
+			return n, nil
+		}
+		if readErr != nil {
+			return n, readErr
+		}
+	}
+}